@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// adaptiveConcurrency limits the number of requests in flight to a limit that
+// adapts to rate limiting, much like TCP congestion control: the limit is
+// halved when Spotify rate limits a request, and grows by one after a limit's
+// worth of successful requests. A nil *adaptiveConcurrency doesn't limit
+// anything.
+type adaptiveConcurrency struct {
+	mu       sync.Mutex
+	min      int
+	max      int
+	limit    float64
+	inFlight int
+
+	// changed is closed, and replaced, whenever a request may start.
+	changed chan struct{}
+
+	// lastDecrease is when the limit was last halved. The requests in flight
+	// at the time are often rate limited together, which counts once.
+	lastDecrease time.Time
+}
+
+func newAdaptiveConcurrency(start int, min int, max int) *adaptiveConcurrency {
+	if start < min {
+		start = min
+	}
+	if start > max {
+		start = max
+	}
+
+	return &adaptiveConcurrency{min: min, max: max, limit: float64(start), changed: make(chan struct{})}
+}
+
+// acquire waits until a request may start.
+func (a *adaptiveConcurrency) acquire(ctx context.Context) error {
+	if a == nil {
+		return nil
+	}
+
+	for {
+		a.mu.Lock()
+		if a.inFlight < int(a.limit) {
+			a.inFlight++
+			a.mu.Unlock()
+			return nil
+		}
+		changed := a.changed
+		a.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// release marks a request started with acquire as done.
+func (a *adaptiveConcurrency) release() {
+	if a == nil {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.inFlight--
+	a.notify()
+}
+
+func (a *adaptiveConcurrency) succeeded() {
+	if a == nil {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.limit >= float64(a.max) {
+		return
+	}
+
+	before := int(a.limit)
+	a.limit += 1 / a.limit
+	if a.limit > float64(a.max) {
+		a.limit = float64(a.max)
+	}
+	if int(a.limit) != before {
+		slog.Debug("Increasing concurrency", "concurrency", int(a.limit))
+		a.notify()
+	}
+}
+
+func (a *adaptiveConcurrency) rateLimited() {
+	if a == nil {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if time.Since(a.lastDecrease) < time.Second {
+		return
+	}
+	a.lastDecrease = time.Now()
+
+	before := int(a.limit)
+	a.limit /= 2
+	if a.limit < float64(a.min) {
+		a.limit = float64(a.min)
+	}
+	if int(a.limit) != before {
+		slog.Debug("Decreasing concurrency after rate limiting", "concurrency", int(a.limit))
+	}
+}
+
+func (a *adaptiveConcurrency) notify() {
+	close(a.changed)
+	a.changed = make(chan struct{})
+}
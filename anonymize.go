@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// anonymousPrefix marks user ids replaced by -anonymize. Ids that already
+// have it, from the playlists of an anonymized run that is resumed, are kept,
+// so the same user has the same id in every file.
+const anonymousPrefix = "anonymous-"
+
+// anonymousId replaces a user id with a hash of it. Users can still be told
+// apart, e.g. in contributors.json, without revealing who they are.
+func anonymousId(id string) string {
+	if id == "" || strings.HasPrefix(id, anonymousPrefix) {
+		return id
+	}
+
+	sum := sha256.Sum256([]byte(id))
+	return anonymousPrefix + hex.EncodeToString(sum[:8])
+}
+
+// anonymizeUser keeps only the hashed id of a user.
+func anonymizeUser(user User) User {
+	return User{Id: anonymousId(user.Id), Type: user.Type}
+}
+
+// anonymizeItems scrubs who added each item and the track preview links.
+func anonymizeItems(items []Item) {
+	for i := range items {
+		if items[i].AddedBy != nil {
+			user := anonymizeUser(*items[i].AddedBy)
+			items[i].AddedBy = &user
+		}
+		items[i].Track.PreviewUrl = ""
+	}
+}
+
+func anonymizeEpisodes(episodes []PlaylistEpisode) {
+	for i := range episodes {
+		if episodes[i].AddedBy != nil {
+			user := anonymizeUser(*episodes[i].AddedBy)
+			episodes[i].AddedBy = &user
+		}
+	}
+}
+
+// anonymizePlaylist scrubs the owner of a playlist.
+func anonymizePlaylist(playlist Playlist) Playlist {
+	playlist.Owner = anonymizeUser(playlist.Owner)
+	return playlist
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	archiveZip   = "zip"
+	archiveTarGz = "targz"
+)
+
+// archiveRun bundles runDir into backup-<run>.zip or backup-<run>.tar.gz next
+// to it and returns the archive path. Files are streamed into the archive one
+// at a time, all with the time the archive was made.
+func archiveRun(runDir string, format string) (string, error) {
+	base := filepath.Join(filepath.Dir(runDir), archivePrefix+filepath.Base(runDir))
+
+	switch format {
+	case archiveZip:
+		return base + ".zip", writeZip(base+".zip", runDir)
+	case archiveTarGz:
+		return base + ".tar.gz", writeTarGz(base+".tar.gz", runDir)
+	}
+
+	return "", errors.Errorf("invalid archive format %q: expected zip or targz", format)
+}
+
+func writeZip(filename string, dir string) error {
+	modified := time.Now()
+	err := storage.Create(filename, func(out io.Writer) error {
+		zw := zip.NewWriter(out)
+		err := storage.Walk(dir, func(path string, rel string, size int64) error {
+			header := &zip.FileHeader{Name: filepath.ToSlash(rel), Method: zip.Deflate, Modified: modified}
+			header.SetMode(0644)
+
+			w, err := zw.CreateHeader(header)
+			if err != nil {
+				return err
+			}
+
+			return copyFileTo(w, path)
+		})
+		if err != nil {
+			return err
+		}
+
+		return zw.Close()
+	})
+
+	return errors.Wrap(err, "failed to write zip archive")
+}
+
+func writeTarGz(filename string, dir string) error {
+	modified := time.Now()
+	err := storage.Create(filename, func(out io.Writer) error {
+		gw := gzip.NewWriter(out)
+		tw := tar.NewWriter(gw)
+		err := storage.Walk(dir, func(path string, rel string, size int64) error {
+			header := &tar.Header{Typeflag: tar.TypeReg, Name: filepath.ToSlash(rel), Size: size, Mode: 0644, ModTime: modified}
+			if err := tw.WriteHeader(header); err != nil {
+				return err
+			}
+
+			return copyFileTo(tw, path)
+		})
+		if err != nil {
+			return err
+		}
+
+		if err := tw.Close(); err != nil {
+			return err
+		}
+		return gw.Close()
+	})
+
+	return errors.Wrap(err, "failed to write tar archive")
+}
+
+func copyFileTo(w io.Writer, path string) error {
+	in, err := storage.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	_, err = io.Copy(w, in)
+	return err
+}
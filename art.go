@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+const artFolder = "art"
+
+// addAlbums records the album of every track in items, keyed by album id so
+// albums shared between playlists are only downloaded once.
+func addAlbums(albums map[string]Album, items []Item) {
+	for _, item := range items {
+		album := item.Track.Album
+		if album.Id != "" && len(album.Images) > 0 {
+			albums[album.Id] = album
+		}
+	}
+}
+
+// largestImage returns the image with the most pixels.
+func largestImage(images []Image) Image {
+	var largest Image
+	for _, image := range images {
+		if largest.Url == "" || image.Width*image.Height > largest.Width*largest.Height {
+			largest = image
+		}
+	}
+
+	return largest
+}
+
+// downloadAlbumArt saves the largest cover of each album as art/<album id>.jpg
+// in dir. Covers already in previousDir, the art folder of an earlier
+// backup, are copied from there instead of being downloaded again.
+func downloadAlbumArt(ctx context.Context, dir string, previousDir string, albums map[string]Album) error {
+	artDir := filepath.Join(dir, artFolder)
+	if err := storage.Mkdir(artDir); err != nil {
+		return errors.Wrap(err, "failed to create art folder")
+	}
+
+	downloaded, copied := 0, 0
+	for id, album := range albums {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		filename := filepath.Join(artDir, id+".jpg")
+		if exists, err := storage.Exists(filename); err == nil && exists {
+			continue
+		}
+
+		if previousDir != "" {
+			if err := copyFile(storage, filepath.Join(previousDir, id+".jpg"), filename); err == nil {
+				copied++
+				continue
+			}
+		}
+
+		if err := downloadFile(ctx, largestImage(album.Images).Url, filename); err != nil {
+			slog.Warn("Error downloading album art", "album", album.Name, "error", err)
+			continue
+		}
+		downloaded++
+	}
+
+	slog.Info("Saved album art", "downloaded", downloaded, "copied", copied, "dir", artDir)
+	return nil
+}
+
+// downloadFile saves the body of url to filename. The whole image is
+// downloaded before it's saved, so an interrupted download doesn't leave a
+// partial image behind.
+func downloadFile(ctx context.Context, url string, filename string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to create request")
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "request failed")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("request to %s failed: %s", url, resp.Status)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrap(err, "failed to download")
+	}
+
+	return storage.Write(filename, data)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+)
+
+const (
+	coverLarge = "https://i.scdn.co/image/ab67616d0000b273large"
+	coverSmall = "https://i.scdn.co/image/ab67616d00004851small"
+	mosaic     = "https://mosaic.scdn.co/640/ab67616d0000b273mosaic"
+)
+
+func TestImageURLsInJSON(t *testing.T) {
+	withFormats(t, formatJSON)
+	m := newMockSpotify(t, map[string]string{
+		"/v1/me/playlists?offset=0&limit=50": page("", 1, `{"id": "p1", "name": "Covers", "images": [{"url": "`+mosaic+`", "width": 640, "height": 640}]}`),
+		"/v1/playlists/p1/tracks?offset=0&limit=100": page("", 1, `{"added_at": "2024-01-15T10:00:00Z", "track": {
+			"id": "t1", "name": "One", "type": "track", "uri": "spotify:track:t1",
+			"album": {"id": "al1", "name": "Album", "images": [
+				{"url": "`+coverSmall+`", "width": 64, "height": 64},
+				{"url": "`+coverLarge+`", "width": 640, "height": 640}
+			]}
+		}}`),
+	})
+	client := m.client()
+
+	playlists, err := client.fetchPlaylists(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := client.fetchPlaylistTracks(context.Background(), playlists[0])
+	if result.Err != nil {
+		t.Fatal(result.Err)
+	}
+
+	dir := t.TempDir()
+	files, err := saveItems(dir, "Covers", "Covers", result.Items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metaFile, err := savePlaylistMetadata(dir, "Covers", playlists[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracks, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, url := range []string{coverSmall, coverLarge} {
+		if !strings.Contains(string(tracks), url) {
+			t.Errorf("album image %s is missing from %s", url, files[0])
+		}
+	}
+	meta, err := os.ReadFile(metaFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(meta), mosaic) {
+		t.Errorf("playlist image %s is missing from %s", mosaic, metaFile)
+	}
+
+	albums := make(map[string]Album)
+	addAlbums(albums, result.Items)
+	if got := largestImage(albums["al1"].Images).Url; got != coverLarge {
+		t.Errorf("largest cover = %s, want %s", got, coverLarge)
+	}
+}
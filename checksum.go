@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// checksumFile lists the SHA-256 of every JSON file in a run folder, in the
+// format of sha256sum, so it can also be checked with sha256sum -c.
+const checksumFile = "checksums.sha256"
+
+// writeChecksums writes the checksum file for the JSON files in dir, sorted
+// by path so the file is the same for the same backup.
+func writeChecksums(dir string) error {
+	sums, err := jsonChecksums(dir)
+	if err != nil {
+		return err
+	}
+
+	paths := make([]string, 0, len(sums))
+	for path := range sums {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var b strings.Builder
+	for _, path := range paths {
+		fmt.Fprintf(&b, "%s  %s\n", sums[path], path)
+	}
+
+	if err := storage.Write(filepath.Join(dir, checksumFile), []byte(b.String())); err != nil {
+		return errors.Wrap(err, "failed to write checksums")
+	}
+
+	return nil
+}
+
+// verifyChecksums checks the JSON files in dir against its checksum file. It
+// logs every changed or missing file and returns how many there were. Files
+// added since, such as a diff_report.json, are only warned about.
+func verifyChecksums(dir string) (int, error) {
+	expected, err := readChecksums(filepath.Join(dir, checksumFile))
+	if err != nil {
+		return 0, err
+	}
+
+	actual, err := jsonChecksums(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	paths := make([]string, 0, len(expected))
+	for path := range expected {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	problems := 0
+	for _, path := range paths {
+		sum, ok := actual[path]
+		switch {
+		case !ok:
+			slog.Error("Missing file", "file", path)
+			problems++
+		case sum != expected[path]:
+			slog.Error("Checksum mismatch", "file", path)
+			problems++
+		}
+		delete(actual, path)
+	}
+
+	unlisted := make([]string, 0, len(actual))
+	for path := range actual {
+		unlisted = append(unlisted, path)
+	}
+	sort.Strings(unlisted)
+	for _, path := range unlisted {
+		slog.Warn("File not in checksums", "file", path)
+	}
+
+	return problems, nil
+}
+
+// jsonChecksums returns the hex SHA-256 of every JSON file in dir, keyed by
+// its slash-separated path relative to dir.
+func jsonChecksums(dir string) (map[string]string, error) {
+	sums := make(map[string]string)
+	err := storage.Walk(dir, func(path string, rel string, size int64) error {
+		if !strings.HasSuffix(rel, ".json") {
+			return nil
+		}
+
+		sum, err := fileChecksum(path)
+		if err != nil {
+			return err
+		}
+		sums[filepath.ToSlash(rel)] = sum
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to compute checksums")
+	}
+
+	return sums, nil
+}
+
+func fileChecksum(path string) (string, error) {
+	file, err := storage.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func readChecksums(filename string) (map[string]string, error) {
+	file, err := storage.Open(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read checksums")
+	}
+	defer file.Close()
+
+	sums := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		sum, path, ok := strings.Cut(scanner.Text(), "  ")
+		if !ok {
+			return nil, errors.Errorf("invalid line in %s: %q", filename, scanner.Text())
+		}
+		sums[path] = sum
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read checksums")
+	}
+
+	return sums, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/term"
+)
+
+const (
+	colorAuto   = "auto"
+	colorAlways = "always"
+	colorNever  = "never"
+
+	ansiRed    = "\x1b[31m"
+	ansiGreen  = "\x1b[32m"
+	ansiYellow = "\x1b[33m"
+	ansiReset  = "\x1b[0m"
+)
+
+// levelSuccess is the level of the summaries logged when something finished
+// without problems. It's shown as INFO, in green with -color.
+const levelSuccess = slog.LevelInfo + 1
+
+// useColor reports whether log output to stderr is colored for the -color
+// mode: auto colors it for a terminal unless NO_COLOR is set.
+func useColor(mode string) (bool, error) {
+	switch mode {
+	case colorAlways:
+		return true, nil
+	case colorNever:
+		return false, nil
+	case colorAuto:
+		return os.Getenv("NO_COLOR") == "" && term.IsTerminal(int(os.Stderr.Fd())), nil
+	}
+
+	return false, errors.Errorf("invalid -color %q: expected auto, always or never", mode)
+}
+
+// levelName shows levelSuccess as INFO, so log parsers only ever see the
+// standard levels.
+func levelName(groups []string, a slog.Attr) slog.Attr {
+	if a.Key == slog.LevelKey && len(groups) == 0 {
+		if level, ok := a.Value.Any().(slog.Level); ok && level == levelSuccess {
+			a.Value = slog.StringValue(slog.LevelInfo.String())
+		}
+	}
+
+	return a
+}
+
+// colorHandler colors the level of each record written by a text handler.
+// The text handler escapes color codes in values, so they are added to its
+// output instead.
+type colorHandler struct {
+	slog.Handler
+	out *colorWriter
+}
+
+func newColorHandler(w io.Writer, opts *slog.HandlerOptions) *colorHandler {
+	out := &colorWriter{w: w}
+	return &colorHandler{Handler: slog.NewTextHandler(out, opts), out: out}
+}
+
+func (h *colorHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.out.mu.Lock()
+	defer h.out.mu.Unlock()
+
+	h.out.level = r.Level
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *colorHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &colorHandler{Handler: h.Handler.WithAttrs(attrs), out: h.out}
+}
+
+func (h *colorHandler) WithGroup(name string) slog.Handler {
+	return &colorHandler{Handler: h.Handler.WithGroup(name), out: h.out}
+}
+
+// colorWriter colors the level=... tag of the record being written, whose
+// level colorHandler sets.
+type colorWriter struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level slog.Level
+}
+
+func (w *colorWriter) Write(p []byte) (int, error) {
+	color := ""
+	switch {
+	case w.level >= slog.LevelError:
+		color = ansiRed
+	case w.level >= slog.LevelWarn:
+		color = ansiYellow
+	case w.level == levelSuccess:
+		color = ansiGreen
+	}
+	if color == "" {
+		return w.w.Write(p)
+	}
+
+	name := slog.LevelInfo.String()
+	if w.level != levelSuccess {
+		name = w.level.String()
+	}
+	tag := []byte(slog.LevelKey + "=" + name)
+	colored := bytes.Replace(p, tag, []byte(slog.LevelKey+"="+color+name+ansiReset), 1)
+	if _, err := w.w.Write(colored); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// command is a subcommand, e.g. "backup" or "restore". Its flags are the
+// program's flags that apply to it, so the options are the same with or
+// without a subcommand.
+type command struct {
+	name  string
+	args  string
+	help  string
+	flags []string // nil for every flag that isn't another command's
+	set   func(args []string) error
+}
+
+var commands = []command{
+	{
+		name: "backup",
+		args: "[options]",
+		help: "Back up your playlists, saved tracks, shows and episodes.",
+		set: func(args []string) error {
+			if len(args) > 0 {
+				return errors.Errorf("unexpected arguments: %s", strings.Join(args, " "))
+			}
+			return nil
+		},
+	},
+	{
+		name:  "restore",
+		args:  "[options] <backup folder>",
+		help:  "Recreate the playlists in a backup folder in your account.",
+		flags: []string{"restore-mode", "port", "token-path", "profile", "proxy", "user-agent", "rps", "max-retries", "timeout", "validate-scopes", "log-level", "color", "quiet", "config", "notify-url"},
+		set: func(args []string) error {
+			if len(args) != 1 {
+				return errors.New("restore needs a backup folder")
+			}
+			*restoreDir = args[0]
+			return nil
+		},
+	},
+	{
+		name:  "verify",
+		args:  "[options] <backup folder>",
+		help:  "Check the files in a backup folder against its checksums.",
+		flags: []string{"log-level", "color", "config"},
+		set: func(args []string) error {
+			if len(args) != 1 {
+				return errors.New("verify needs a backup folder")
+			}
+			*verifyDir = args[0]
+			return nil
+		},
+	},
+	{
+		name:  "diff",
+		args:  "[options] <old folder> <new folder>",
+		help:  "Compare two backups and write diff_report.json to the new one.",
+		flags: []string{"log-level", "color", "config", "indent", "compact"},
+		set: func(args []string) error {
+			if len(args) != 2 {
+				return errors.New("diff needs two backup folders")
+			}
+			*diffMode = true
+			return nil
+		},
+	},
+	{
+		name:  "serve",
+		args:  "[options] <backup folder>",
+		help:  "Browse a backup folder in a web browser.",
+		flags: []string{"serve-port", "log-level", "color", "config"},
+		set: func(args []string) error {
+			if len(args) != 1 {
+				return errors.New("serve needs a backup folder")
+			}
+			*serveDir = args[0]
+			return nil
+		},
+	},
+}
+
+// commandFlags are the flags that choose what a run does, and are replaced by
+// the commands.
+var commandFlags = map[string]bool{"restore": true, "verify": true, "diff": true, "serve": true}
+
+// cmdArgs are the arguments left after the flags.
+var cmdArgs []string
+
+func (c command) hasFlag(name string) bool {
+	if c.flags == nil {
+		return !commandFlags[name] && name != "restore-mode" && name != "serve-port"
+	}
+	for _, f := range c.flags {
+		if f == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isFlagSet reports whether the flag name was given on the command line or
+// in the config file, rather than left at its default.
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+
+	return set
+}
+
+// parseCommandLine parses the subcommand and its flags. Without a command,
+// only flags, they are parsed as before so existing scripts keep working.
+func parseCommandLine() {
+	flag.Usage = usage
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(exitUsage)
+	}
+	if strings.HasPrefix(os.Args[1], "-") {
+		flag.Parse()
+		cmdArgs = flag.Args()
+		return
+	}
+
+	var cmd *command
+	for i := range commands {
+		if commands[i].name == os.Args[1] {
+			cmd = &commands[i]
+		}
+	}
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", os.Args[1])
+		usage()
+		os.Exit(exitUsage)
+	}
+
+	fs := flag.NewFlagSet(cmd.name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s %s\n\n%s\n\nOptions:\n", programName(), cmd.name, cmd.args, cmd.help)
+		fs.PrintDefaults()
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		if cmd.hasFlag(f.Name) {
+			fs.Var(f.Value, f.Name, f.Usage)
+		}
+	})
+	fs.Parse(os.Args[2:])
+
+	// Mark the flags as given on the command line too, so the config file
+	// doesn't replace them.
+	fs.Visit(func(f *flag.Flag) { flag.Set(f.Name, f.Value.String()) })
+
+	cmdArgs = fs.Args()
+	if err := cmd.set(cmdArgs); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n\n", err)
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [options]\n\nCommands:\n", programName())
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", cmd.name, cmd.help)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun %s <command> -h for the options of a command.\n", programName())
+}
+
+func programName() string {
+	return filepath.Base(os.Args[0])
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// configEnv maps the config file keys that aren't flags to the environment
+// variables they stand in for.
+var configEnv = map[string]string{
+	"client_id":     "SPOTIFY_CLIENT_ID",
+	"client_secret": "SPOTIFY_CLIENT_SECRET",
+	"redirect_url":  "SPOTIFY_REDIRECT_URL",
+}
+
+// flagEnv lists the flags that can also be set with an environment variable,
+// which takes precedence over the config file.
+var flagEnv = map[string]string{
+	"output": "BACKUP_DIR",
+	"format": "BACKUP_FORMAT",
+	"port":   "CALLBACK_PORT",
+}
+
+// loadConfig applies the options in a JSON config file. Keys are flag names,
+// plus the credentials in configEnv. Options given as flags or environment
+// variables are left alone, so the config file only replaces the defaults.
+func loadConfig(filename string) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return errors.Wrap(err, "failed to read config file")
+	}
+
+	var config map[string]interface{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return errors.Wrapf(err, "failed to parse config file %s", filename)
+	}
+
+	setFlags := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { setFlags[f.Name] = true })
+
+	keys := make([]string, 0, len(config))
+	for key := range config {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := fmt.Sprint(config[key])
+
+		if env, ok := configEnv[key]; ok {
+			if os.Getenv(env) == "" {
+				os.Setenv(env, value)
+			}
+			continue
+		}
+
+		if key == "config" || flag.Lookup(key) == nil {
+			return errors.Errorf("unknown option %q in config file %s", key, filename)
+		}
+		if setFlags[key] || os.Getenv(flagEnv[key]) != "" {
+			continue
+		}
+		if err := flag.Set(key, value); err != nil {
+			return errors.Wrapf(err, "invalid value for %q in config file %s", key, filename)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// DiffReport lists what changed between two backup runs.
+type DiffReport struct {
+	Old     string         `json:"old"`
+	New     string         `json:"new"`
+	Created []DiffPlaylist `json:"created"`
+	Deleted []DiffPlaylist `json:"deleted"`
+	Changed []PlaylistDiff `json:"changed"`
+}
+
+type DiffPlaylist struct {
+	Name       string `json:"name"`
+	Id         string `json:"id"`
+	TrackCount int    `json:"track_count"`
+}
+
+type PlaylistDiff struct {
+	Name    string      `json:"name"`
+	Id      string      `json:"id"`
+	Added   []DiffTrack `json:"added"`
+	Removed []DiffTrack `json:"removed"`
+}
+
+type DiffTrack struct {
+	Track   string `json:"track"`
+	Artists string `json:"artists"`
+	TrackId string `json:"track_id,omitempty"`
+}
+
+// diffBackups compares the backup runs in oldDir and newDir, writes
+// diff_report.json to newDir and prints a summary.
+func diffBackups(oldDir string, newDir string) error {
+	oldPlaylists, err := loadBackupPlaylists(oldDir)
+	if err != nil {
+		return errors.Wrapf(err, "failed to load backup %s", oldDir)
+	}
+	newPlaylists, err := loadBackupPlaylists(newDir)
+	if err != nil {
+		return errors.Wrapf(err, "failed to load backup %s", newDir)
+	}
+
+	report := diffPlaylists(oldPlaylists, newPlaylists)
+	report.Old, report.New = oldDir, newDir
+
+	filename, err := saveJSONToFile(newDir, "diff_report", report)
+	if err != nil {
+		return err
+	}
+	printDiff(report)
+	fmt.Printf("\nWrote %s\n", filename)
+
+	return nil
+}
+
+type backupPlaylist struct {
+	Playlist Playlist
+	Items    []Item
+}
+
+// loadBackupPlaylists reads every playlist listed in the manifest of dir, in
+// manifest order.
+func loadBackupPlaylists(dir string) ([]backupPlaylist, error) {
+	manifest, err := readManifest(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read manifest")
+	}
+
+	playlists := make([]backupPlaylist, 0, len(manifest.Playlists))
+	for _, entry := range manifest.Playlists {
+		playlist, items, err := loadPlaylistBackup(dir, entry)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to load playlist %s", entry.Name)
+		}
+		playlists = append(playlists, backupPlaylist{Playlist: playlist, Items: items})
+	}
+
+	return playlists, nil
+}
+
+// diffPlaylists matches playlists by id and tracks by the same key as the
+// combined export: the track id, or the ISRC or name for tracks without one.
+func diffPlaylists(oldPlaylists []backupPlaylist, newPlaylists []backupPlaylist) DiffReport {
+	report := DiffReport{
+		Created: make([]DiffPlaylist, 0),
+		Deleted: make([]DiffPlaylist, 0),
+		Changed: make([]PlaylistDiff, 0),
+	}
+
+	oldById := make(map[string]backupPlaylist)
+	for _, p := range oldPlaylists {
+		oldById[p.Playlist.Id] = p
+	}
+	newById := make(map[string]bool)
+
+	for _, p := range newPlaylists {
+		newById[p.Playlist.Id] = true
+		old, ok := oldById[p.Playlist.Id]
+		if !ok {
+			report.Created = append(report.Created, DiffPlaylist{Name: p.Playlist.Name, Id: p.Playlist.Id, TrackCount: len(p.Items)})
+			continue
+		}
+
+		diff := PlaylistDiff{
+			Name:    p.Playlist.Name,
+			Id:      p.Playlist.Id,
+			Added:   missingTracks(p.Items, old.Items),
+			Removed: missingTracks(old.Items, p.Items),
+		}
+		if len(diff.Added) > 0 || len(diff.Removed) > 0 {
+			report.Changed = append(report.Changed, diff)
+		}
+	}
+
+	for _, p := range oldPlaylists {
+		if !newById[p.Playlist.Id] {
+			report.Deleted = append(report.Deleted, DiffPlaylist{Name: p.Playlist.Name, Id: p.Playlist.Id, TrackCount: len(p.Items)})
+		}
+	}
+
+	return report
+}
+
+// missingTracks returns the tracks in items that aren't in other.
+func missingTracks(items []Item, other []Item) []DiffTrack {
+	seen := make(map[string]bool, len(other))
+	for _, item := range other {
+		seen[combinedKey(item.Track)] = true
+	}
+
+	missing := make([]DiffTrack, 0)
+	for _, item := range items {
+		key := combinedKey(item.Track)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		missing = append(missing, DiffTrack{
+			Track:   item.Track.Name,
+			Artists: artistNames(item.Track.Artists, ", "),
+			TrackId: item.Track.Id,
+		})
+	}
+
+	return missing
+}
+
+func printDiff(report DiffReport) {
+	if len(report.Created) == 0 && len(report.Deleted) == 0 && len(report.Changed) == 0 {
+		fmt.Println("No changes")
+		return
+	}
+
+	for _, p := range report.Created {
+		fmt.Printf("New playlist: %s (%d tracks)\n", p.Name, p.TrackCount)
+	}
+	for _, p := range report.Deleted {
+		fmt.Printf("Deleted playlist: %s (%d tracks)\n", p.Name, p.TrackCount)
+	}
+	for _, p := range report.Changed {
+		fmt.Printf("%s: %d added, %d removed\n", p.Name, len(p.Added), len(p.Removed))
+		for _, t := range p.Added {
+			fmt.Printf("  + %s - %s\n", t.Artists, t.Track)
+		}
+		for _, t := range p.Removed {
+			fmt.Printf("  - %s - %s\n", t.Artists, t.Track)
+		}
+	}
+}
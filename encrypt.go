@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/scrypt"
+)
+
+// encryptedToken is the on-disk form of an encrypted token cache. Salt is
+// only set when the key was derived from a passphrase.
+type encryptedToken struct {
+	Version    int    `json:"version"`
+	Salt       []byte `json:"salt,omitempty"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// tokenKey turns TOKEN_ENCRYPTION_KEY into an AES-256 key. A 32 byte value is
+// used as is; anything else is treated as a passphrase and run through scrypt.
+func tokenKey(secret string, salt []byte) ([]byte, error) {
+	if len(secret) == 32 && salt == nil {
+		return []byte(secret), nil
+	}
+
+	key, err := scrypt.Key([]byte(secret), salt, 1<<15, 8, 1, 32)
+	return key, errors.Wrap(err, "failed to derive encryption key")
+}
+
+// encryptToken seals the marshaled token with AES-256-GCM.
+func encryptToken(plaintext []byte, secret string) ([]byte, error) {
+	var salt []byte
+	if len(secret) != 32 {
+		salt = make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, errors.Wrap(err, "failed to generate salt")
+		}
+	}
+
+	gcm, err := tokenCipher(secret, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, errors.Wrap(err, "failed to generate nonce")
+	}
+
+	return json.Marshal(encryptedToken{
+		Version:    1,
+		Salt:       salt,
+		Nonce:      nonce,
+		Ciphertext: gcm.Seal(nil, nonce, plaintext, nil),
+	})
+}
+
+// decryptToken reverses encryptToken. ok is false if data isn't an encrypted
+// token cache, i.e. a plaintext cache from before encryption was enabled.
+func decryptToken(data []byte, secret string) (plaintext []byte, ok bool, err error) {
+	var sealed encryptedToken
+	if err := json.Unmarshal(data, &sealed); err != nil || sealed.Ciphertext == nil {
+		return nil, false, nil
+	}
+
+	if secret == "" {
+		return nil, true, errors.New("token cache is encrypted but TOKEN_ENCRYPTION_KEY is not set")
+	}
+
+	gcm, err := tokenCipher(secret, sealed.Salt)
+	if err != nil {
+		return nil, true, err
+	}
+
+	plaintext, err = gcm.Open(nil, sealed.Nonce, sealed.Ciphertext, nil)
+	if err != nil {
+		return nil, true, errors.New("failed to decrypt token cache: wrong TOKEN_ENCRYPTION_KEY?")
+	}
+
+	return plaintext, true, nil
+}
+
+func tokenCipher(secret string, salt []byte) (cipher.AEAD, error) {
+	key, err := tokenKey(secret, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create cipher")
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	return gcm, errors.Wrap(err, "failed to create cipher")
+}
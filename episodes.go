@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+)
+
+// PlaylistEpisode is a podcast episode in a playlist, kept apart from the
+// music tracks in <name>.episodes.json with -include-episodes.
+type PlaylistEpisode struct {
+	Position int     `json:"position"`
+	AddedAt  string  `json:"added_at"`
+	AddedBy  *User   `json:"added_by,omitempty"`
+	Episode  Episode `json:"episode"`
+}
+
+// UnmarshalJSON decodes a playlist item, which holds either a track or an
+// episode. Episodes are decoded into Episode, leaving Track empty.
+func (item *Item) UnmarshalJSON(data []byte) error {
+	type plainItem Item
+	var raw struct {
+		plainItem
+		Track json.RawMessage `json:"track"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*item = Item(raw.plainItem)
+
+	if len(raw.Track) == 0 || string(raw.Track) == "null" {
+		return nil
+	}
+
+	var kind struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(raw.Track, &kind); err != nil {
+		return err
+	}
+	if kind.Type == "episode" {
+		item.Episode = &Episode{}
+		return json.Unmarshal(raw.Track, item.Episode)
+	}
+
+	return json.Unmarshal(raw.Track, &item.Track)
+}
+
+// splitEpisodes separates the episodes in a playlist from its tracks.
+func splitEpisodes(items []Item) ([]Item, []PlaylistEpisode) {
+	tracks := make([]Item, 0, len(items))
+	episodes := make([]PlaylistEpisode, 0)
+	for _, item := range items {
+		if item.Episode == nil {
+			tracks = append(tracks, item)
+			continue
+		}
+		episodes = append(episodes, PlaylistEpisode{
+			Position: item.Position,
+			AddedAt:  item.AddedAt,
+			AddedBy:  item.AddedBy,
+			Episode:  *item.Episode,
+		})
+	}
+
+	return tracks, episodes
+}
+
+func savePlaylistEpisodes(dir string, name string, episodes []PlaylistEpisode) (string, error) {
+	filename := backupFilePath(dir, name, "episodes.json")
+	return filename, writeJSON(filename, episodes)
+}
+
+// episodes returns the previously backed up episodes of playlist. Backups
+// made without -include-episodes have none.
+func (b *previousBackup) episodes(playlist Playlist) ([]PlaylistEpisode, bool) {
+	entry, ok := b.entries[playlist.Id]
+	if !ok {
+		return nil, false
+	}
+
+	for _, file := range entry.Files {
+		if strings.HasSuffix(file, ".episodes.json") {
+			var episodes []PlaylistEpisode
+			if err := readJSON(filepath.Join(b.dir, file), &episodes); err != nil {
+				return nil, false
+			}
+			return episodes, true
+		}
+	}
+
+	return nil, false
+}
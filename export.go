@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	formatJSON   = "json"
+	formatCSV    = "csv"
+	formatM3U    = "m3u"
+	formatHTML   = "html"
+	formatNDJSON = "ndjson"
+)
+
+var csvHeader = []string{"name", "artists", "album", "added_at", "duration_ms", "isrc", "spotify_url"}
+
+// tabularArtists returns the artists of a track for the flat formats: their
+// names joined with ";", or with -flatten-artists, the names and the ids
+// joined with -artist-sep.
+func tabularArtists(artists []Artist) (string, string) {
+	if !*flattenArtists {
+		return artistNames(artists, ";"), ""
+	}
+
+	ids := make([]string, len(artists))
+	for i, artist := range artists {
+		ids[i] = artist.Id
+	}
+
+	return artistNames(artists, *artistSep), strings.Join(ids, *artistSep)
+}
+
+// parseFormats turns the -format value, a comma-separated list of formats,
+// into the set of formats to write. "both" is shorthand for json,csv.
+func parseFormats(value string) (map[string]bool, error) {
+	formats := make(map[string]bool)
+	for _, format := range strings.Split(value, ",") {
+		switch format = strings.TrimSpace(format); format {
+		case formatJSON, formatCSV, formatM3U, formatHTML, formatNDJSON, formatParquet:
+			formats[format] = true
+		case "both":
+			formats[formatJSON] = true
+			formats[formatCSV] = true
+		default:
+			return nil, errors.Errorf("invalid format %q: expected json, csv, m3u, html, ndjson, parquet or both", format)
+		}
+	}
+
+	return formats, nil
+}
+
+// ndjsonRecord is one line of an NDJSON file: an item along with the name of
+// the playlist it's from, and with -flatten-artists, its artists.
+type ndjsonRecord struct {
+	Playlist  string `json:"playlist"`
+	Artists   string `json:"artists,omitempty"`
+	ArtistIds string `json:"artist_ids,omitempty"`
+	Item
+}
+
+// saveNDJSONToFile writes items as JSON Lines, one unindented object per line.
+func saveNDJSONToFile(dir string, name string, playlist string, items []Item) (string, error) {
+	filename := backupFilePath(dir, name, "ndjson")
+	err := storage.Create(filename, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		for _, item := range items {
+			record := ndjsonRecord{Playlist: playlist, Item: item}
+			if *flattenArtists {
+				record.Artists, record.ArtistIds = tabularArtists(item.Track.Artists)
+			}
+			if err := enc.Encode(record); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "failed to write NDJSON file")
+	}
+
+	return filename, nil
+}
+
+func saveCSVToFile(dir string, name string, items []Item) (string, error) {
+	filename := backupFilePath(dir, name, "csv")
+	err := storage.Create(filename, func(out io.Writer) error {
+		w := csv.NewWriter(out)
+		header := csvHeader
+		if *flattenArtists {
+			header = append(append([]string(nil), csvHeader...), "artist_ids")
+		}
+		w.Write(header)
+		for _, item := range items {
+			w.Write(csvRecord(item))
+		}
+
+		w.Flush()
+		return w.Error()
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "failed to write CSV file")
+	}
+
+	return filename, nil
+}
+
+func csvRecord(item Item) []string {
+	names, ids := tabularArtists(item.Track.Artists)
+	record := []string{
+		item.Track.Name,
+		names,
+		item.Track.Album.Name,
+		item.AddedAt,
+		strconv.Itoa(item.Track.DurationMs),
+		item.Track.ExternalIds.Isrc,
+		item.Track.ExternalUrls.Spotify,
+	}
+	if *flattenArtists {
+		record = append(record, ids)
+	}
+
+	return record
+}
+
+func artistNames(artists []Artist, sep string) string {
+	names := make([]string, len(artists))
+	for i, artist := range artists {
+		names[i] = artist.Name
+	}
+
+	return strings.Join(names, sep)
+}
+
+// saveM3UToFile writes an extended M3U playlist with the Spotify URI of each
+// track. Local tracks and items without a track id are skipped.
+func saveM3UToFile(dir string, name string, items []Item) (string, error) {
+	filename := backupFilePath(dir, name, "m3u8")
+	err := storage.Create(filename, func(w io.Writer) error {
+		fmt.Fprintln(w, "#EXTM3U")
+		for _, item := range items {
+			track := item.Track
+			if track.IsLocal || track.Id == "" {
+				continue
+			}
+
+			seconds := (track.DurationMs + 500) / 1000
+			fmt.Fprintf(w, "#EXTINF:%d,%s - %s\n", seconds, artistNames(track.Artists, ", "), track.Name)
+			fmt.Fprintln(w, track.Uri)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "failed to write M3U file")
+	}
+
+	return filename, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Exit codes, so scripts and cron jobs can tell a complete backup from one
+// with gaps. Usage errors exit with 2, like the flag package does.
+const (
+	exitFailed     = 1
+	exitUsage      = 2
+	exitIncomplete = 3
+)
+
+// FailedPlaylist is an entry in failed.json, for a playlist whose tracks
+// couldn't be fetched even after the retry pass.
+type FailedPlaylist struct {
+	Name  string `json:"name"`
+	Id    string `json:"id"`
+	Error string `json:"error"`
+}
+
+func failedPlaylists(results []playlistResult) []FailedPlaylist {
+	failed := make([]FailedPlaylist, len(results))
+	for i, result := range results {
+		failed[i] = FailedPlaylist{
+			Name:  result.Playlist.Name,
+			Id:    result.Playlist.Id,
+			Error: result.Err.Error(),
+		}
+	}
+
+	return failed
+}
+
+// incompleteError is returned by run for a backup that was written, but is
+// missing playlists that failed or other parts that couldn't be fetched. It
+// has already been notified about, so it only sets the exit code.
+type incompleteError struct {
+	failed  int
+	missing []string
+}
+
+func (e *incompleteError) Error() string {
+	var parts []string
+	if e.failed > 0 {
+		parts = append(parts, fmt.Sprintf("%d playlists failed, see failed.json", e.failed))
+	}
+	if len(e.missing) > 0 {
+		parts = append(parts, "couldn't fetch "+strings.Join(e.missing, " and "))
+	}
+
+	return "backup is incomplete: " + strings.Join(parts, "; ")
+}
+
+// exitCode returns the code to exit with after err ended the program.
+func exitCode(err error) int {
+	var incomplete *incompleteError
+	if errors.As(err, &incomplete) {
+		return exitIncomplete
+	}
+
+	return exitFailed
+}
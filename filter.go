@@ -0,0 +1,166 @@
+package main
+
+import (
+	"log/slog"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// filterPlaylists keeps the playlists matching names, a comma-separated list
+// of playlist names or ids, or the regular expression pattern. With neither
+// set, all playlists are kept. Names that match nothing are reported along
+// with the available playlist names.
+func filterPlaylists(playlists []Playlist, names string, pattern string) ([]Playlist, error) {
+	if names == "" && pattern == "" {
+		return playlists, nil
+	}
+
+	var re *regexp.Regexp
+	if pattern != "" {
+		var err error
+		re, err = regexp.Compile(pattern)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid -playlists-regex")
+		}
+	}
+
+	var order []string
+	wanted := make(map[string]bool)
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			order = append(order, name)
+			wanted[name] = false
+		}
+	}
+
+	filtered := make([]Playlist, 0)
+	for _, p := range playlists {
+		_, byName := wanted[p.Name]
+		_, byId := wanted[p.Id]
+		if byName {
+			wanted[p.Name] = true
+		}
+		if byId {
+			wanted[p.Id] = true
+		}
+
+		if byName || byId || (re != nil && re.MatchString(p.Name)) {
+			filtered = append(filtered, p)
+		}
+	}
+
+	var missing []string
+	for _, name := range order {
+		if !wanted[name] {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		available := make([]string, len(playlists))
+		for i, p := range playlists {
+			available[i] = p.Name
+		}
+		slog.Warn("No playlist found", "playlists", strings.Join(missing, ", "), "available", strings.Join(available, ", "))
+	}
+
+	return filtered, nil
+}
+
+// filterVisibility drops the playlists excluded by -only-public, -only-private
+// and -skip-collaborative. Spotify only reports whether a playlist is public
+// reliably for the user's own playlists, so others may be misjudged.
+func filterVisibility(playlists []Playlist, onlyPublic bool, onlyPrivate bool, skipCollaborative bool) []Playlist {
+	if !onlyPublic && !onlyPrivate && !skipCollaborative {
+		return playlists
+	}
+
+	filtered := make([]Playlist, 0, len(playlists))
+	for _, p := range playlists {
+		if (onlyPublic && !p.Public) || (onlyPrivate && p.Public) || (skipCollaborative && p.Collaborative) {
+			continue
+		}
+		filtered = append(filtered, p)
+	}
+	if skipped := len(playlists) - len(filtered); skipped > 0 {
+		slog.Info("Skipping playlists by visibility", "skipped", skipped)
+	}
+
+	return filtered
+}
+
+// limitPlaylists keeps the first n playlists, or all of them if n is 0.
+func limitPlaylists(playlists []Playlist, n int) []Playlist {
+	if n > 0 && len(playlists) > n {
+		slog.Info("Limiting playlists", "limit", n, "skipped", len(playlists)-n)
+		return playlists[:n]
+	}
+
+	return playlists
+}
+
+// parseSince parses the -since cutoff, either an RFC 3339 time or a date.
+func parseSince(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, errors.Errorf("invalid -since %q: expected a date like 2024-01-15 or an RFC 3339 time", value)
+	}
+
+	return t, nil
+}
+
+// filterSince keeps the items added on or after cutoff. Items without a
+// usable added_at are kept only if includeUndated is set.
+func filterSince(items []Item, cutoff time.Time, includeUndated bool) []Item {
+	filtered := make([]Item, 0, len(items))
+	for _, item := range items {
+		addedAt, err := time.Parse(time.RFC3339, item.AddedAt)
+		if err != nil {
+			if includeUndated {
+				filtered = append(filtered, item)
+			}
+			continue
+		}
+
+		if !addedAt.Before(cutoff) {
+			filtered = append(filtered, item)
+		}
+	}
+
+	return filtered
+}
+
+// filterAddedBy keeps the items added by the user with id userId.
+func filterAddedBy(items []Item, userId string) []Item {
+	filtered := make([]Item, 0, len(items))
+	for _, item := range items {
+		if item.AddedBy != nil && item.AddedBy.Id == userId {
+			filtered = append(filtered, item)
+		}
+	}
+
+	return filtered
+}
+
+// dropUnavailable removes the items Spotify returns without a track, which
+// happens for tracks removed from the catalog and for podcast episodes in
+// music playlists. Local tracks have no id either, but are kept. It returns
+// the remaining items and the number removed; positions are left as they
+// were, so gaps show where the removed items were.
+func dropUnavailable(items []Item) ([]Item, int) {
+	kept := make([]Item, 0, len(items))
+	for _, item := range items {
+		if item.Track.Id == "" && !item.Track.IsLocal {
+			continue
+		}
+		kept = append(kept, item)
+	}
+
+	return kept, len(items) - len(kept)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+// unavailablePage has a track removed from the catalog, which Spotify returns
+// as a null track, between two playable tracks and a local one.
+const unavailablePage = `{
+	"items": [
+		{"added_at": "2024-01-15T10:00:00Z", "track": {"id": "t1", "name": "One", "type": "track", "uri": "spotify:track:t1"}},
+		{"added_at": "2024-01-16T10:00:00Z", "track": null},
+		{"added_at": "2024-01-17T10:00:00Z", "track": {"id": null, "name": "Demo", "type": "track", "is_local": true, "uri": "spotify:local:::Demo:120"}},
+		{"added_at": "2024-01-18T10:00:00Z"},
+		{"added_at": "2024-01-19T10:00:00Z", "track": {"id": "t2", "name": "Two", "type": "track", "uri": "spotify:track:t2"}}
+	],
+	"next": null,
+	"total": 5
+}`
+
+func TestDropUnavailableNullTrack(t *testing.T) {
+	var page TracksPage
+	if err := json.Unmarshal([]byte(unavailablePage), &page); err != nil {
+		t.Fatal(err)
+	}
+	for i := range page.Items {
+		page.Items[i].Position = i
+	}
+
+	items, removed := dropUnavailable(page.Items)
+	if removed != 2 {
+		t.Errorf("removed %d items, want 2", removed)
+	}
+
+	want := []struct {
+		name     string
+		position int
+	}{{"One", 0}, {"Demo", 2}, {"Two", 4}}
+	if len(items) != len(want) {
+		t.Fatalf("kept %d items, want %d", len(items), len(want))
+	}
+	for i, w := range want {
+		if items[i].Track.Name != w.name || items[i].Position != w.position {
+			t.Errorf("item %d = %q at position %d, want %q at position %d", i, items[i].Track.Name, items[i].Position, w.name, w.position)
+		}
+	}
+}
+
+func TestFetchPlaylistTracksNullTrack(t *testing.T) {
+	m := newMockSpotify(t, map[string]string{
+		"/v1/playlists/p1/tracks?offset=0&limit=100": unavailablePage,
+	})
+
+	result := m.client().fetchPlaylistTracks(context.Background(), Playlist{Id: "p1", Name: "Playlist"})
+	if result.Err != nil {
+		t.Fatal(result.Err)
+	}
+	if len(result.Items) != 3 {
+		t.Errorf("got %d tracks, want 3", len(result.Items))
+	}
+	for _, item := range result.Items {
+		if item.Track.Id == "" && !item.Track.IsLocal {
+			t.Errorf("unavailable item at position %d was kept", item.Position)
+		}
+	}
+}
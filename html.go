@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var templateFuncs = template.FuncMap{
+	"artists":  func(artists []Artist) string { return artistNames(artists, ", ") },
+	"duration": formatDuration,
+	"inc":      func(i int) int { return i + 1 },
+}
+
+var playlistTemplate = template.Must(template.New("playlist").Funcs(templateFuncs).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+</head>
+<body>
+<p><a href="index.html">All playlists</a></p>
+<h1>{{.Title}}</h1>
+<p>{{len .Items}} tracks</p>
+<table>
+<tr><th>#</th><th>Track</th><th>Artist</th><th>Album</th><th>Duration</th><th>Added</th></tr>
+{{- range $i, $item := .Items}}
+<tr>
+<td>{{inc $i}}</td>
+<td>{{if $item.Track.ExternalUrls.Spotify}}<a href="{{$item.Track.ExternalUrls.Spotify}}">{{$item.Track.Name}}</a>{{else}}{{$item.Track.Name}}{{end}}</td>
+<td>{{artists $item.Track.Artists}}</td>
+<td>{{$item.Track.Album.Name}}</td>
+<td>{{duration $item.Track.DurationMs}}</td>
+<td>{{$item.AddedAt}}</td>
+</tr>
+{{- end}}
+</table>
+</body>
+</html>
+`))
+
+var indexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Spotify backup {{.Timestamp}}</title>
+</head>
+<body>
+<h1>Spotify backup</h1>
+<p>Backed up {{.Timestamp}}: {{.TotalPlaylists}} playlists with {{.TotalTracks}} tracks, and {{.SavedTracks}} saved tracks.</p>
+<ul>
+{{- if .SavedTracksFile}}
+<li><a href="{{.SavedTracksFile}}">Saved tracks</a> ({{.SavedTracks}} tracks)</li>
+{{- end}}
+{{- range .Playlists}}
+<li>{{if .File}}<a href="{{.File}}">{{.Name}}</a>{{else}}{{.Name}}{{end}} ({{.TrackCount}} tracks)</li>
+{{- end}}
+</ul>
+</body>
+</html>
+`))
+
+func formatDuration(ms int) string {
+	seconds := ms / 1000
+	return fmt.Sprintf("%d:%02d", seconds/60, seconds%60)
+}
+
+func saveHTMLToFile(dir string, name string, title string, items []Item) (string, error) {
+	filename := backupFilePath(dir, name, "html")
+	err := writeTemplate(filename, playlistTemplate, struct {
+		Title string
+		Items []Item
+	}{title, items})
+
+	return filename, err
+}
+
+type indexEntry struct {
+	Name       string
+	TrackCount int
+	File       string
+}
+
+// writeHTMLIndex writes an index.html linking the HTML page of every playlist
+// in the manifest.
+func writeHTMLIndex(dir string, manifest *Manifest, savedTracksFile string) error {
+	entries := make([]indexEntry, len(manifest.Playlists))
+	for i, p := range manifest.Playlists {
+		entries[i] = indexEntry{Name: p.Name, TrackCount: p.TrackCount}
+		for _, file := range p.Files {
+			if strings.HasSuffix(file, ".html") {
+				entries[i].File = url.PathEscape(file)
+			}
+		}
+	}
+
+	if savedTracksFile != "" {
+		savedTracksFile = url.PathEscape(filepath.Base(savedTracksFile))
+	}
+
+	return writeTemplate(filepath.Join(dir, "index.html"), indexTemplate, struct {
+		*Manifest
+		Playlists       []indexEntry
+		SavedTracksFile string
+	}{manifest, entries, savedTracksFile})
+}
+
+func writeTemplate(filename string, tmpl *template.Template, data interface{}) error {
+	err := storage.Create(filename, func(w io.Writer) error {
+		return tmpl.Execute(w, data)
+	})
+
+	return errors.Wrap(err, "failed to write HTML file")
+}
@@ -1,36 +1,156 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
-	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/joho/godotenv"
 	"github.com/pkg/errors"
 	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+	"golang.org/x/time/rate"
 )
 
 const (
-	authURL        = "https://accounts.spotify.com/authorize"
-	tokenURL       = "https://accounts.spotify.com/api/token"
+	authURL    = "https://accounts.spotify.com/authorize"
+	tokenURL   = "https://accounts.spotify.com/api/token"
+	appVersion = "0.1.0"
+)
+
+var (
+	// baseAPIAddress is where new clients send their requests. Tests of
+	// whole runs point it at a mock server.
 	baseAPIAddress = "https://api.spotify.com"
+
+	defaultCallbackPort = "8080"
+	scopes              = []string{"playlist-read-private", "user-library-read", "user-read-playback-position", "user-read-private"}
 )
 
 var (
-	redirectURL = "http://localhost:8080/callback"
-	scopes      = []string{"playlist-read-private", "user-library-read"}
+	byYear          = flag.Bool("by-year", false, "Write tracks_by_year.json with saved tracks grouped by the year they were added")
+	byYearPlaylists = flag.Bool("by-year-playlists", false, "Include playlist tracks in the -by-year export; needs -by-year")
+	reportContribs  = flag.Bool("report-contributors", false, "Write contributors.json with per-user track counts for collaborative playlists")
+	callbackPort    = flag.String("port", "", "Port for the local OAuth callback server (default 8080, or CALLBACK_PORT)")
+	parallelPages   = flag.Int("parallel-pages", 1, "Number of pages of a large playlist to fetch in parallel. Uses up the -rps budget faster")
+	retryFailed     = flag.Bool("retry-failed-playlists", true, "Fetch the playlists that failed once more at the end of the run, with longer waits between retries")
+	concurrency     = flag.Int("concurrency", 3, "Number of playlists to fetch in parallel")
+	minConcurrency  = flag.Int("min-concurrency", 1, "Fewest requests in flight with -max-concurrency")
+	maxConcurrency  = flag.Int("max-concurrency", 0, "Adapt the number of requests in flight to rate limiting, up to this many, starting from -concurrency (default off)")
+	timeout         = flag.Duration("timeout", 0, "Give up if the whole run takes longer than this, e.g. 30m (default no limit)")
+	interval        = flag.Duration("interval", 0, "Keep running and make a backup every interval, e.g. 24h (default a single backup)")
+	metricsPort     = flag.Int("metrics-port", 0, "With -interval, serve the stats of the last backup for scraping at http://localhost:<port>/metrics (default off)")
+	rps             = flag.Float64("rps", 3, "Maximum number of Spotify API requests per second")
+	maxRetries      = flag.Int("max-retries", 5, "Maximum number of retries for a rate-limited, failed or timed out request")
+	playlistNames   = flag.String("playlists", "", "Comma-separated names or ids of the playlists to back up (default all)")
+	playlistRegex   = flag.String("playlists-regex", "", "Only back up playlists whose name matches this regular expression")
+	limitFlag       = flag.Int("limit-playlists", 0, "Only back up the first N playlists, after the other playlist filters (default all)")
+	onlyPublic      = flag.Bool("only-public", false, "Only back up public playlists")
+	onlyPrivate     = flag.Bool("only-private", false, "Only back up private playlists, including collaborative ones")
+	skipCollab      = flag.Bool("skip-collaborative", false, "Don't back up collaborative playlists")
+	skipPlaylists   = flag.Bool("skip-playlists", false, "Don't back up playlists, only your saved tracks, shows and episodes")
+	skipSaved       = flag.Bool("skip-saved", false, "Don't back up your saved tracks, shows and episodes, only playlists")
+	userFlag        = flag.String("user", "", "Back up the public playlists of this Spotify user id instead of your own")
+	publicOnly      = flag.Bool("public-only", false, "Back up -user without logging in, with an app token from the client id and secret")
+	sinceFlag       = flag.String("since", "", "Only back up tracks added on or after this date (RFC 3339 or YYYY-MM-DD)")
+	sinceUndated    = flag.Bool("since-include-undated", false, "Keep tracks without an added date when using -since")
+	addedByFlag     = flag.String("added-by", "", "Only back up the tracks this user id added to collaborative playlists, skipping other playlists")
+	marketFlag      = flag.String("market", "", "Country code (e.g. NO) whose catalog tracks are relinked to, or from_token for your own (default)")
+	includeMarkets  = flag.Bool("include-markets", false, "Keep the countries each track is available in. Makes the backup several times larger")
+	downloadArt     = flag.Bool("download-art", false, "Download the cover of every album in the backup to the art folder")
+	playlistDetails = flag.Bool("include-playlist-details", false, "Fetch each playlist's follower count and full description. One more API call per playlist")
+	maxTracks       = flag.Int("max-tracks-per-playlist", 0, "Only back up the first N tracks of each playlist (default all)")
+	includeEpisodes = flag.Bool("include-episodes", false, "Write the podcast episodes in each playlist to <playlist>.episodes.json")
+	audioFeatures   = flag.Bool("audio-features", false, "Add audio features (tempo, key, energy, ...) to each track. Doubles the number of API calls")
+	resumeDir       = flag.String("resume", "", "Continue an interrupted backup in the given run folder, skipping the playlists already in it")
+	fullBackup      = flag.Bool("full", false, "Fetch every playlist, even those unchanged since the last backup")
+	outputFlag      = flag.String("output", "", "Folder or s3://bucket/prefix URL to write backups to (default \"backups\", or BACKUP_DIR)")
+	archiveFormat   = flag.String("archive", "", "Bundle the backup run into a single archive: zip or targz")
+	keepRuns        = flag.Int("keep", 0, "After a successful backup, delete all but the N most recent runs (default keep all)")
+	maxAge          = flag.Duration("max-age", 0, "After a successful backup, delete runs older than this, e.g. 720h (default keep all)")
+	archiveCleanup  = flag.Bool("archive-cleanup", false, "Delete the backup folder after creating the -archive")
+	dryRun          = flag.Bool("dry-run", false, "List what would be backed up without fetching tracks or writing files")
+	restoreMode     = flag.String("restore-mode", restoreCreate, "What -restore does with playlists that already exist: create (skip them), replace or append")
+	restoreDir      = flag.String("restore", "", "Recreate the playlists in the given backup folder instead of backing up")
+	verifyDir       = flag.String("verify", "", "Check the files in the given backup folder against its checksums.sha256")
+	serveDir        = flag.String("serve", "", "Browse the backup in the given folder in a web browser, at http://localhost:<serve-port>/")
+	servePort       = flag.Int("serve-port", 8090, "Port the -serve browser listens on")
+	diffMode        = flag.Bool("diff", false, "Compare two backup folders given as arguments, e.g. -diff old new, and write diff_report.json to the new one")
+	flattenArtists  = flag.Bool("flatten-artists", false, "In CSV, NDJSON and Parquet files, join the artists with -artist-sep and add their ids in artist_ids")
+	artistSep       = flag.String("artist-sep", "; ", "Separator between artists with -flatten-artists")
+	formatFlag      = flag.String("format", "", "Comma-separated backup formats: json, csv, m3u, html, ndjson, parquet or both (default json, or BACKUP_FORMAT)")
+	logLevel        = flag.String("log-level", "info", "Log level: debug, info, warn or error")
+	colorFlag       = flag.String("color", colorAuto, "Color log levels: auto (when logging to a terminal and NO_COLOR isn't set), always or never")
+	quiet           = flag.Bool("quiet", false, "Don't log progress for every fetched page")
+	combined        = flag.Bool("combined", false, "Write all_tracks.json with every unique track and the playlists it appears in")
+	dedupBy         = flag.String("dedup-by", dedupById, "What -combined matches tracks by: id, or isrc to merge re-releases of the same recording")
+	isrcIndex       = flag.Bool("isrc-index", false, "Write isrc_index.json mapping each track's ISRC to its name, artists and playlists")
+	summaries       = flag.Bool("playlist-summaries", false, "Write <playlist>.summary.json with the duration, explicit tracks, average popularity and added dates of each playlist")
+	reportDups      = flag.Bool("report-duplicates", false, "Write duplicates.json listing tracks that appear more than once in a playlist")
+	anonymize       = flag.Bool("anonymize", false, "Replace user ids with hashes and leave out your profile and preview links, for sharing backups")
+	compactFlag     = flag.Bool("compact", false, "Write JSON files without indentation or line breaks; can't be used with -indent")
+	indentFlag      = flag.String("indent", "2", "JSON indentation: a number of spaces or \"tab\"")
+	profileFlag     = flag.String("profile", "", "Name of the Spotify account to use, with its own token cache and backup folder")
+	tokenPathFlag   = flag.String("token-path", "", "Token cache file (default token_cache.json in the user config folder)")
+	validateScopes  = flag.Bool("validate-scopes", false, "Check that the cached token has every scope this run needs, and log in again if not")
+	userAgent       = flag.String("user-agent", defaultUserAgent, "User-Agent header sent with every request")
+	proxyFlag       = flag.String("proxy", "", "Proxy URL for all requests (default from HTTPS_PROXY and HTTP_PROXY)")
+	notifyURL       = flag.String("notify-url", "", "Webhook URL to POST a JSON summary to when the backup finishes or fails")
+	configFile      = flag.String("config", "", "JSON file with default options; flags and environment variables take precedence")
+
+	jsonIndent  = "  "
+	compactJSON = false
+	tokenPath   = tokenCacheFile
+	formats     = map[string]bool{formatJSON: true}
 )
 
 type Playlist struct {
-	Name string `json:"name"`
-	Id   string `json:"id"`
+	Name          string         `json:"name"`
+	Id            string         `json:"id"`
+	Description   string         `json:"description"`
+	Owner         User           `json:"owner"`
+	Collaborative bool           `json:"collaborative"`
+	Public        bool           `json:"public"`
+	SnapshotId    string         `json:"snapshot_id"`
+	Followers     *Followers     `json:"followers,omitempty"`
+	Images        []Image        `json:"images"`
+	Tracks        PlaylistTracks `json:"tracks"`
+	ExternalUrls  ExternalUrl    `json:"external_urls"`
+	Href          string         `json:"href"`
+	Uri           string         `json:"uri"`
+}
+
+// Followers is only included by the playlist details endpoint, see
+// -include-playlist-details.
+type Followers struct {
+	Total int `json:"total"`
+}
+
+// PlaylistTracks is the track summary included in playlist listings.
+type PlaylistTracks struct {
+	Href  string `json:"href"`
+	Total int    `json:"total"`
 }
 
 type PlaylistPage struct {
@@ -54,29 +174,81 @@ type TracksPage struct {
 }
 
 type Item struct {
-	AddedAt string `json:"added_at"`
-	Track   Track  `json:"track"`
+	// Position is the index of the item in its playlist (or saved tracks),
+	// so the original order survives independently of the array order.
+	Position int    `json:"position"`
+	AddedAt  string `json:"added_at"`
+	AddedBy  *User  `json:"added_by,omitempty"`
+	Track    Track  `json:"track"`
+
+	// Episode is set instead of Track for podcast episodes in playlists,
+	// which are written to a file of their own.
+	Episode *Episode `json:"-"`
 }
 
 type Track struct {
-	Album        Album       `json:"album"`
-	Artists      []Artist    `json:"artists"`
-	DiscNumber   int         `json:"disc_number"`
-	DurationMs   int         `json:"duration_ms"`
-	Explicit     bool        `json:"explicit"`
-	ExternalIds  ExternalId  `json:"external_ids"`
+	Album         Album          `json:"album"`
+	Artists       []Artist       `json:"artists"`
+	DiscNumber    int            `json:"disc_number"`
+	DurationMs    int            `json:"duration_ms"`
+	Explicit      bool           `json:"explicit"`
+	ExternalIds   ExternalId     `json:"external_ids"`
+	ExternalUrls  ExternalUrl    `json:"external_urls"`
+	Href          string         `json:"href"`
+	Id            string         `json:"id"`
+	IsLocal       bool           `json:"is_local"`
+	Name          string         `json:"name"`
+	Popularity    int            `json:"popularity"`
+	PreviewUrl    string         `json:"preview_url"`
+	TrackNumber   int            `json:"track_number"`
+	Type          string         `json:"type"`
+	Uri           string         `json:"uri"`
+	AudioFeatures *AudioFeatures `json:"audio_features,omitempty"`
+
+	// AvailableMarkets is only kept with -include-markets. Spotify leaves
+	// it out when a market is given.
+	AvailableMarkets []string `json:"available_markets,omitempty"`
+
+	// LinkedFrom is the track that is actually in the playlist when Spotify
+	// relinked it to another version playable in the market. Id and Uri are
+	// then those of the playable version.
+	LinkedFrom *LinkedFrom `json:"linked_from,omitempty"`
+}
+
+type LinkedFrom struct {
 	ExternalUrls ExternalUrl `json:"external_urls"`
 	Href         string      `json:"href"`
 	Id           string      `json:"id"`
-	IsLocal      bool        `json:"is_local"`
-	Name         string      `json:"name"`
-	Popularity   int         `json:"popularity"`
-	PreviewUrl   string      `json:"preview_url"`
-	TrackNumber  int         `json:"track_number"`
 	Type         string      `json:"type"`
 	Uri          string      `json:"uri"`
 }
 
+// originalUri returns the URI of the track as it was added to the playlist,
+// before any relinking.
+func (t Track) originalUri() string {
+	if t.LinkedFrom != nil && t.LinkedFrom.Uri != "" {
+		return t.LinkedFrom.Uri
+	}
+
+	return t.Uri
+}
+
+type AudioFeatures struct {
+	Acousticness     float64 `json:"acousticness"`
+	Danceability     float64 `json:"danceability"`
+	Energy           float64 `json:"energy"`
+	Id               string  `json:"id"`
+	Instrumentalness float64 `json:"instrumentalness"`
+	Key              int     `json:"key"`
+	Liveness         float64 `json:"liveness"`
+	Loudness         float64 `json:"loudness"`
+	Mode             int     `json:"mode"`
+	Speechiness      float64 `json:"speechiness"`
+	Tempo            float64 `json:"tempo"`
+	TimeSignature    int     `json:"time_signature"`
+	Valence          float64 `json:"valence"`
+}
+
 type Album struct {
 	AlbumGroup           string      `json:"album_group"`
 	AlbumType            string      `json:"album_type"`
@@ -102,6 +274,17 @@ type Artist struct {
 	Uri          string      `json:"uri"`
 }
 
+type User struct {
+	DisplayName  string      `json:"display_name,omitempty"`
+	Country      string      `json:"country,omitempty"`
+	Product      string      `json:"product,omitempty"`
+	ExternalUrls ExternalUrl `json:"external_urls"`
+	Href         string      `json:"href"`
+	Id           string      `json:"id"`
+	Type         string      `json:"type"`
+	Uri          string      `json:"uri"`
+}
+
 type ExternalUrl struct {
 	Spotify string `json:"spotify"`
 }
@@ -116,48 +299,399 @@ type Image struct {
 	Width  int    `json:"width"`
 }
 
+type ShowsPage struct {
+	Items    []SavedShow `json:"items"`
+	Href     string      `json:"href"`
+	Limit    int         `json:"limit"`
+	Next     string      `json:"next"`
+	Offset   int         `json:"offset"`
+	Previous string      `json:"previous"`
+	Total    int         `json:"total"`
+}
+
+type SavedShow struct {
+	AddedAt string `json:"added_at"`
+	Show    Show   `json:"show"`
+}
+
+type Show struct {
+	Description   string      `json:"description"`
+	Explicit      bool        `json:"explicit"`
+	ExternalUrls  ExternalUrl `json:"external_urls"`
+	Href          string      `json:"href"`
+	Id            string      `json:"id"`
+	Images        []Image     `json:"images"`
+	Languages     []string    `json:"languages"`
+	MediaType     string      `json:"media_type"`
+	Name          string      `json:"name"`
+	Publisher     string      `json:"publisher"`
+	TotalEpisodes int         `json:"total_episodes"`
+	Type          string      `json:"type"`
+	Uri           string      `json:"uri"`
+}
+
+type EpisodesPage struct {
+	Items    []SavedEpisode `json:"items"`
+	Href     string         `json:"href"`
+	Limit    int            `json:"limit"`
+	Next     string         `json:"next"`
+	Offset   int            `json:"offset"`
+	Previous string         `json:"previous"`
+	Total    int            `json:"total"`
+}
+
+type SavedEpisode struct {
+	AddedAt string  `json:"added_at"`
+	Episode Episode `json:"episode"`
+}
+
+type Episode struct {
+	Description  string      `json:"description"`
+	DurationMs   int         `json:"duration_ms"`
+	Explicit     bool        `json:"explicit"`
+	ExternalUrls ExternalUrl `json:"external_urls"`
+	Href         string      `json:"href"`
+	Id           string      `json:"id"`
+	Images       []Image     `json:"images"`
+	Language     string      `json:"language"`
+	Name         string      `json:"name"`
+	ReleaseDate  string      `json:"release_date"`
+	Show         *Show       `json:"show,omitempty"`
+	Type         string      `json:"type"`
+	Uri          string      `json:"uri"`
+}
+
 // Helper functions
 
-func oauthFlow(ctx context.Context, conf *oauth2.Config) *oauth2.Token {
-	// Start OAuth flow.
-	state := "random-string-for-state-check"
+// setupLogging installs the default slog logger at the given level, with
+// colored levels depending on the -color mode. Messages from the log package,
+// which are all fatal errors, are logged as errors.
+func setupLogging(level string, colorMode string) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return errors.Errorf("invalid log level %q: expected debug, info, warn or error", level)
+	}
+
+	color, err := useColor(colorMode)
+	if err != nil {
+		return err
+	}
+
+	opts := &slog.HandlerOptions{Level: l, ReplaceAttr: levelName}
+	if color {
+		slog.SetDefault(slog.New(newColorHandler(os.Stderr, opts)))
+	} else {
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, opts)))
+	}
+	slog.SetLogLoggerLevel(slog.LevelError)
+
+	return nil
+}
+
+// logPage logs the per-page progress of a fetch, which -quiet and the
+// progress bar silence.
+func logPage(msg string, args ...any) {
+	if !*quiet && progress == nil {
+		slog.Info(msg, args...)
+	}
+}
 
-	url := conf.AuthCodeURL(state)
+// requiredEnv lists the environment variables the program can't run without.
+// SPOTIFY_CLIENT_SECRET is optional, since PKCE is used when it's not set.
+var requiredEnv = []string{"SPOTIFY_CLIENT_ID"}
+
+func missingEnv() []string {
+	var missing []string
+	for _, name := range requiredEnv {
+		if os.Getenv(name) == "" {
+			missing = append(missing, name)
+		}
+	}
+
+	return missing
+}
+
+func credentialsHelp(missing []string) string {
+	return fmt.Sprintf(`Missing required environment variable: %s
+
+Create an app at https://developer.spotify.com/dashboard, add
+http://localhost:%s/callback as a redirect URI and copy its client ID.
+Then export it, or put it in a .env file in the working directory:
+
+    SPOTIFY_CLIENT_ID=your-client-id
+    # Optional; without it the PKCE flow is used.
+    SPOTIFY_CLIENT_SECRET=your-client-secret
+`, strings.Join(missing, ", "), defaultCallbackPort)
+}
+
+// checkMarket accepts an ISO 3166-1 alpha-2 country code or from_token.
+func checkMarket(market string) error {
+	if market == "" || market == "from_token" {
+		return nil
+	}
+	if len(market) == 2 && isUpperLetter(market[0]) && isUpperLetter(market[1]) {
+		return nil
+	}
+
+	return errors.Errorf("invalid market %q: expected a two-letter country code such as NO, or from_token", market)
+}
+
+func isUpperLetter(c byte) bool {
+	return c >= 'A' && c <= 'Z'
+}
+
+func parseIndent(value string) (string, error) {
+	if value == "tab" {
+		return "\t", nil
+	}
+
+	spaces, err := strconv.Atoi(value)
+	if err != nil || spaces < 0 {
+		return "", errors.Errorf("invalid indent %q: expected a number of spaces or \"tab\"", value)
+	}
+
+	return strings.Repeat(" ", spaces), nil
+}
+
+// callbackConfig resolves the OAuth redirect URL and the address the callback
+// server listens on. SPOTIFY_REDIRECT_URL and the -port flag (or CALLBACK_PORT)
+// can each be given alone; the missing one is derived from the other.
+func callbackConfig() (redirectURL string, addr string, path string, err error) {
+	port := *callbackPort
+	if port == "" {
+		port = os.Getenv("CALLBACK_PORT")
+	}
+
+	redirectURL = os.Getenv("SPOTIFY_REDIRECT_URL")
+	if redirectURL == "" {
+		if port == "" {
+			port = defaultCallbackPort
+		}
+		redirectURL = fmt.Sprintf("http://localhost:%s/callback", port)
+	}
+
+	u, err := url.Parse(redirectURL)
+	if err != nil {
+		return "", "", "", errors.Wrapf(err, "invalid redirect URL %q", redirectURL)
+	}
+
+	if port == "" {
+		port = u.Port()
+	}
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	if _, err := strconv.Atoi(port); err != nil {
+		return "", "", "", errors.Errorf("invalid callback port %q", port)
+	}
+
+	path = u.Path
+	if path == "" {
+		path = "/"
+	}
+
+	return redirectURL, ":" + port, path, nil
+}
+
+// randomURLSafeString returns n random bytes encoded as unpadded base64url.
+func randomURLSafeString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "failed to generate random bytes")
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// pkceOptions returns the authorization and exchange options for the
+// Authorization Code with PKCE flow, using an S256 code challenge.
+func pkceOptions() (authOpts []oauth2.AuthCodeOption, exchangeOpts []oauth2.AuthCodeOption, err error) {
+	verifier, err := randomURLSafeString(32)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sum := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	authOpts = []oauth2.AuthCodeOption{
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+		oauth2.SetAuthURLParam("code_challenge", challenge),
+	}
+	exchangeOpts = []oauth2.AuthCodeOption{
+		oauth2.SetAuthURLParam("code_verifier", verifier),
+	}
+
+	return authOpts, exchangeOpts, nil
+}
+
+// oauthFlow runs the authorization code flow: it prints the authorization URL,
+// waits for Spotify to redirect back to the local callback server and returns
+// the exchanged token once the server has shut down. Without a client secret
+// the PKCE flow is used.
+func oauthFlow(ctx context.Context, conf *oauth2.Config, addr string, callbackPath string) (*oauth2.Token, error) {
+	// Start OAuth flow. The state is random per run to protect against CSRF.
+	state, err := randomURLSafeString(32)
+	if err != nil {
+		return nil, err
+	}
+
+	var authOpts, exchangeOpts []oauth2.AuthCodeOption
+	if conf.ClientSecret == "" {
+		authOpts, exchangeOpts, err = pkceOptions()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	url := conf.AuthCodeURL(state, authOpts...)
 
 	fmt.Printf("Visit the following URL to authorize the app: \n%v\n", url)
 
-	// Start callback server.
-	http.HandleFunc("/callback", func(w http.ResponseWriter, r *http.Request) {
+	type result struct {
+		token *oauth2.Token
+		err   error
+	}
+	results := make(chan result, 1)
+	send := func(r result) {
+		// Only the first result is used; later callbacks are dropped.
+		select {
+		case results <- r:
+		default:
+		}
+	}
+
+	// Start callback server. The handler is registered on a mux of its own,
+	// so the flow can run again in the same process to re-authorize.
+	mux := http.NewServeMux()
+	mux.HandleFunc(callbackPath, func(w http.ResponseWriter, r *http.Request) {
 		query := r.URL.Query()
 		code := query.Get("code")
 		receivedState := query.Get("state")
 
+		// A callback with the wrong state didn't come from our authorization
+		// request. Reject it and keep waiting for the real one.
 		if state != receivedState {
-			log.Fatalf("Invalid state received: %s", receivedState)
+			slog.Warn("Ignoring callback with invalid state")
+			http.Error(w, "Invalid state. Please start the authorization again from the URL in the terminal.", http.StatusBadRequest)
+			return
 		}
 
-		token, err := conf.Exchange(ctx, code)
+		token, err := conf.Exchange(ctx, code, exchangeOpts...)
 		if err != nil {
-			log.Fatalf("Error exchanging authorization code: %v", err)
+			http.Error(w, "Authorization failed. Check the terminal for details.", http.StatusInternalServerError)
+			send(result{err: errors.Wrap(err, "failed to exchange authorization code")})
+			return
 		}
 
-		saveToken(token)
 		fmt.Fprintf(w, "Authorization successful. You can close this window.")
-		os.Exit(0)
+		send(result{token: token})
 	})
 
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			send(result{err: errors.Wrap(err, "callback server failed")})
+		}
+	}()
 
-	// The code execution should not reach here.
-	return nil
+	var res result
+	select {
+	case res = <-results:
+	case <-ctx.Done():
+		res = result{err: ctx.Err()}
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Error shutting down callback server", "error", err)
+	}
+
+	return res.token, res.err
+}
+
+// tokenCacheFile is the token cache name, both in the user config folder and
+// in the working directory where older versions kept it.
+const tokenCacheFile = "token_cache.json"
+
+// profileTokenCacheFile is the token cache name for a -profile.
+func profileTokenCacheFile(profile string) string {
+	return fmt.Sprintf("token_cache_%s.json", profile)
+}
+
+// defaultTokenPath returns the token cache path in the user config folder,
+// moving a token cache left in the working directory by older versions there.
+// Each -profile has a token cache of its own.
+func defaultTokenPath(profile string) string {
+	name := tokenCacheFile
+	if profile != "" {
+		name = profileTokenCacheFile(profile)
+	}
+
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		slog.Warn("No user config folder, keeping the token cache in the working directory", "error", err)
+		return name
+	}
+
+	path := filepath.Join(configDir, "spotify-playlist-backup", name)
+	if profile != "" {
+		// Older versions had no profiles, so there is nothing to move.
+		return path
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		return path
+	}
+	if _, err := os.Stat(tokenCacheFile); err != nil {
+		return path
+	}
+
+	if err := migrateTokenCache(tokenCacheFile, path); err != nil {
+		slog.Warn("Error moving token cache, using the one in the working directory", "error", err)
+		return tokenCacheFile
+	}
+	slog.Info("Moved token cache", "path", path)
+
+	return path
+}
+
+func migrateTokenCache(from string, to string) error {
+	if err := os.MkdirAll(filepath.Dir(to), 0700); err != nil {
+		return err
+	}
+
+	// Rename fails across file systems, so fall back to copying.
+	if err := os.Rename(from, to); err == nil {
+		return nil
+	}
+	if err := copyFile(FSStorage{}, from, to); err != nil {
+		return err
+	}
+	if err := os.Chmod(to, 0600); err != nil {
+		return err
+	}
+
+	return os.Remove(from)
 }
 
 func loadToken() (*oauth2.Token, error) {
-	file, err := ioutil.ReadFile("token_cache.json")
+	file, err := ioutil.ReadFile(tokenPath)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to read token cache file")
 	}
 
+	plaintext, encrypted, err := decryptToken(file, os.Getenv("TOKEN_ENCRYPTION_KEY"))
+	if err != nil {
+		return nil, err
+	}
+	if encrypted {
+		file = plaintext
+	}
+
 	var token oauth2.Token
 	err = json.Unmarshal(file, &token)
 	if err != nil {
@@ -167,132 +701,689 @@ func loadToken() (*oauth2.Token, error) {
 	return &token, nil
 }
 
-func saveToken(token *oauth2.Token) {
+func saveToken(token *oauth2.Token) error {
 	data, err := json.Marshal(token)
 	if err != nil {
-		log.Fatalf("Error marshaling token: %v", err)
+		return errors.Wrap(err, "failed to marshal token")
+	}
+
+	if key := os.Getenv("TOKEN_ENCRYPTION_KEY"); key != "" {
+		data, err = encryptToken(data, key)
+		if err != nil {
+			return errors.Wrap(err, "failed to encrypt token")
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(tokenPath), 0700); err != nil {
+		return errors.Wrap(err, "failed to create token cache folder")
 	}
 
-	err = ioutil.WriteFile("token_cache.json", data, 0600)
+	err = writeFileAtomic(tokenPath, 0600, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+
+	return errors.Wrap(err, "failed to save token cache")
+}
+
+// savingTokenSource writes every newly minted token back to the token cache,
+// so refreshed (and rotated) tokens survive between runs.
+type savingTokenSource struct {
+	src  oauth2.TokenSource
+	last *oauth2.Token
+}
+
+func (s *savingTokenSource) Token() (*oauth2.Token, error) {
+	token, err := s.src.Token()
 	if err != nil {
-		log.Fatalf("Error saving token cache: %v", err)
+		return nil, errors.Wrap(err, "failed to refresh token")
 	}
+
+	if s.last == nil || token.AccessToken != s.last.AccessToken || token.RefreshToken != s.last.RefreshToken {
+		if err := saveToken(token); err != nil {
+			return nil, err
+		}
+		s.last = token
+	}
+
+	return token, nil
 }
 
-func fetchPlaylists(client *http.Client) ([]Playlist, error) {
-	limit := 50
-	playlists := make([]Playlist, 0)
-	nextPageUrl := fmt.Sprintf("%s/v1/me/playlists?offset=0&limit=%d", baseAPIAddress, limit)
+func newTokenSource(ctx context.Context, conf *oauth2.Config, token *oauth2.Token) oauth2.TokenSource {
+	return oauth2.ReuseTokenSource(token, &savingTokenSource{
+		src:  conf.TokenSource(ctx, token),
+		last: token,
+	})
+}
 
-	for nextPageUrl != "" {
-		resp, err := client.Get(nextPageUrl)
+// userTokenSource returns the token source for the logged in user: the
+// cached token, or a new one from the authorization flow if there is none or
+// it can't be refreshed, or with -validate-scopes, lacks a scope.
+func userTokenSource(ctx context.Context, conf *oauth2.Config, callbackAddr string, callbackPath string) (oauth2.TokenSource, error) {
+	// Load cached token or start OAuth flow.
+	token, err := loadToken()
+	if err != nil {
+		token, err = oauthFlow(ctx, conf, callbackAddr, callbackPath)
 		if err != nil {
-			resp.Body.Close()
-			return nil, errors.Wrap(err, "failed to fetch playlists")
+			return nil, errors.Wrap(err, "failed to authorize")
 		}
-		data, err := ioutil.ReadAll(resp.Body)
+		if err := saveToken(token); err != nil {
+			return nil, err
+		}
+	}
+
+	tokenSource := newTokenSource(ctx, conf, token)
+
+	// Refresh an expired token up front rather than halfway through the backup.
+	if !token.Valid() {
+		if _, err := tokenSource.Token(); err != nil {
+			slog.Warn("Error refreshing cached token, re-authorizing", "error", err)
+			token, err = oauthFlow(ctx, conf, callbackAddr, callbackPath)
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to authorize")
+			}
+			if err := saveToken(token); err != nil {
+				return nil, err
+			}
+			tokenSource = newTokenSource(ctx, conf, token)
+		}
+	}
+
+	// A token from before a scope was added would fail halfway through the
+	// run, so log in again up front instead.
+	if *validateScopes {
+		var missing []string
+		token, missing, err = checkScopes(ctx, conf, token)
 		if err != nil {
-			return nil, errors.Wrap(err, "failed to read playlists response")
+			return nil, errors.Wrap(err, "failed to check token scopes")
 		}
+		if len(missing) > 0 {
+			slog.Warn("Cached token is missing scopes, re-authorizing", "missing", strings.Join(missing, " "))
+			token, err = oauthFlow(ctx, conf, callbackAddr, callbackPath)
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to authorize")
+			}
+			if err := saveToken(token); err != nil {
+				return nil, err
+			}
+		}
+		tokenSource = newTokenSource(ctx, conf, token)
+	}
+
+	return tokenSource, nil
+}
 
-		var page PlaylistPage
-		json.Unmarshal(data, &page)
-		playlists = append(playlists, page.Items...)
-		fmt.Printf("Fetched %d playlists\n", len(playlists))
-		nextPageUrl = page.Next
+// appTokenSource returns a token source for the app itself, from the client
+// credentials grant. It needs no login, but only gives access to public data,
+// so nothing under /v1/me.
+func appTokenSource(ctx context.Context, conf *oauth2.Config) oauth2.TokenSource {
+	cc := &clientcredentials.Config{
+		ClientID:     conf.ClientID,
+		ClientSecret: conf.ClientSecret,
+		TokenURL:     conf.Endpoint.TokenURL,
 	}
 
-	return playlists, nil
+	return cc.TokenSource(ctx)
 }
 
-func fetchPlaylistTracks(client *http.Client, playlist Playlist) ([]Item, error) {
-	limit := 100
-	tracks := make([]Item, 0)
-	nextPageUrl := fmt.Sprintf("%s/v1/playlists/%s/tracks?offset=0&limit=%d", baseAPIAddress, playlist.Id, limit)
+// backupFilePath returns the path for a backup file in dir with the given
+// name and extension.
+func backupFilePath(dir string, name string, ext string) string {
+	return filepath.Join(dir, fmt.Sprintf("%s.%s", sanitizeFilename(name), ext))
+}
 
-	for nextPageUrl != "" {
-		resp, err := client.Get(nextPageUrl)
-		if err != nil {
-			resp.Body.Close()
-			return nil, errors.Wrapf(err, "failed to fetch tracks for playlist %s", playlist.Name)
+// maxFilenameBytes leaves room for an id suffix and extension within the
+// common 255 byte file name limit.
+const maxFilenameBytes = 200
+
+// windowsReservedNames can't be used as file names on Windows, with or
+// without an extension.
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// sanitizeFilename makes name safe to use as a file name on Linux, macOS and
+// Windows. Only characters that are illegal on one of them are replaced, so
+// names in any script, and emoji, stay readable.
+func sanitizeFilename(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		if r < 0x20 || r == 0x7f || strings.ContainsRune(`/\<>:"|?*`, r) {
+			r = '-'
+		}
+		if b.Len()+utf8.RuneLen(r) > maxFilenameBytes {
+			break
 		}
+		b.WriteRune(r)
+	}
 
-		data, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			resp.Body.Close()
-			return nil, errors.Wrap(err, "failed to read tracks response")
+	// Windows doesn't allow trailing dots or spaces, which also rules out
+	// "." and "..".
+	safe := strings.TrimRight(strings.TrimSpace(b.String()), ". ")
+	if safe == "" {
+		return "_"
+	}
+
+	if windowsReservedNames[strings.ToUpper(strings.SplitN(safe, ".", 2)[0])] {
+		safe = "_" + safe
+	}
+
+	return safe
+}
+
+// reservedFilenames are used by the run itself and never given to a playlist.
+var reservedFilenames = []string{
+	"manifest", "saved_tracks", "saved_shows", "saved_episodes",
+	"contributors", "duplicates", "tracks_by_year", "index", "all_tracks",
+	"diff_report", "stats", "isrc_index", "profile", "failed",
+}
+
+// fileNamer hands out file names for the playlists of a run. When two
+// playlists sanitize to the same name, the later one gets a suffix from its id.
+// Names are compared case-insensitively for case-insensitive file systems.
+type fileNamer struct {
+	seen map[string]bool
+}
+
+func newFileNamer() *fileNamer {
+	n := &fileNamer{seen: make(map[string]bool)}
+	for _, name := range reservedFilenames {
+		n.seen[strings.ToLower(name)] = true
+	}
+
+	return n
+}
+
+func (n *fileNamer) name(name string, id string) string {
+	base := sanitizeFilename(name)
+	if n.seen[strings.ToLower(base)] {
+		suffix := id
+		if len(suffix) > 6 {
+			suffix = suffix[:6]
+		}
+		unique := withSuffix(base, suffix)
+
+		if n.seen[strings.ToLower(unique)] {
+			unique = withSuffix(base, id)
 		}
+		base = unique
+	}
+	n.seen[strings.ToLower(base)] = true
 
-		var page TracksPage
-		json.Unmarshal(data, &page)
-		tracks = append(tracks, page.Items...)
+	return base
+}
 
-		fmt.Printf("Fetched %d tracks for playlist %s. Total tracks: %d\n", len(page.Items), playlist.Name, len(tracks))
-		nextPageUrl = page.Next
+// withSuffix appends "-" and suffix to the sanitized name base. Long names
+// are shortened first, so the length limit never cuts off the suffix and
+// makes two names collide again.
+func withSuffix(base string, suffix string) string {
+	for len(base)+1+len(suffix) > maxFilenameBytes {
+		_, size := utf8.DecodeLastRuneInString(base)
+		base = base[:len(base)-size]
 	}
-	return tracks, nil
+
+	return sanitizeFilename(base + "-" + suffix)
 }
 
-func fetchSavedTracks(client *http.Client) ([]Item, error) {
-	limit := 50
-	tracks := make([]Item, 0)
+func saveJSONToFile(dir string, name string, data interface{}) (string, error) {
+	filename := backupFilePath(dir, name, "json")
+	return filename, writeJSON(filename, data)
+}
+
+// savePlaylistMetadata writes the playlist details next to its track backup,
+// so a restore has enough to recreate the playlist itself.
+func savePlaylistMetadata(dir string, name string, playlist Playlist) (string, error) {
+	filename := backupFilePath(dir, name, "meta.json")
+	return filename, writeJSON(filename, playlist)
+}
+
+// writeJSON saves data to filename as indented JSON. Track lists are written
+// one item at a time, so a huge playlist is never held in memory as JSON all
+// at once; the output is the same as json.MarshalIndent.
+func writeJSON(filename string, data interface{}) error {
+	err := storage.Create(filename, func(w io.Writer) error {
+		if items, ok := data.([]Item); ok {
+			return writeJSONArray(w, items)
+		}
+		return writeJSONValue(w, data, "")
+	})
+
+	return errors.Wrapf(err, "failed to write %s", filepath.Base(filename))
+}
 
-	nextPageUrl := fmt.Sprintf("%s/v1/me/tracks?offset=0&limit=%d", baseAPIAddress, limit)
+// writeFileAtomic writes filename through write, first to filename.tmp and
+// then renamed into place. A run that is killed or runs out of disk space
+// halfway through leaves the previous file, not a truncated one.
+func writeFileAtomic(filename string, perm os.FileMode, write func(w io.Writer) error) error {
+	tmp := filename + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(file)
+	err = write(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
 
-	for {
-		resp, err := client.Get(nextPageUrl)
+	return os.Rename(tmp, filename)
+}
+
+func writeJSONArray(w io.Writer, items []Item) error {
+	if len(items) == 0 {
+		return writeJSONValue(w, items, "")
+	}
+
+	open, sep, end := "[\n"+jsonIndent, ",\n"+jsonIndent, "\n]"
+	if compactJSON {
+		open, sep, end = "[", ",", "]"
+	}
+
+	if _, err := io.WriteString(w, open); err != nil {
+		return err
+	}
+	for i, item := range items {
+		if i > 0 {
+			if _, err := io.WriteString(w, sep); err != nil {
+				return err
+			}
+		}
+		if err := writeJSONValue(w, item, jsonIndent); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, end)
+	return err
+}
+
+// writeJSONValue writes v indented, with every line after the first starting
+// with prefix, or without any whitespace with -compact.
+func writeJSONValue(w io.Writer, v interface{}, prefix string) error {
+	var data []byte
+	var err error
+	if compactJSON {
+		data, err = json.Marshal(v)
+	} else {
+		data, err = json.MarshalIndent(v, prefix, jsonIndent)
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal JSON")
+	}
+
+	_, err = w.Write(data)
+	return err
+}
+
+// saveItems writes a track backup in each of the selected formats and returns
+// the files written. The title is only used in HTML pages.
+func saveItems(dir string, name string, title string, items []Item) ([]string, error) {
+	writers := []struct {
+		format string
+		save   func() (string, error)
+	}{
+		{formatJSON, func() (string, error) { return saveJSONToFile(dir, name, items) }},
+		{formatCSV, func() (string, error) { return saveCSVToFile(dir, name, items) }},
+		{formatM3U, func() (string, error) { return saveM3UToFile(dir, name, items) }},
+		{formatHTML, func() (string, error) { return saveHTMLToFile(dir, name, title, items) }},
+		{formatNDJSON, func() (string, error) { return saveNDJSONToFile(dir, name, title, items) }},
+		{formatParquet, func() (string, error) { return saveParquetToFile(dir, name, items) }},
+	}
+
+	var files []string
+	for _, w := range writers {
+		if !formats[w.format] {
+			continue
+		}
+		file, err := w.save()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+
+	return files, nil
+}
+
+// printPlan lists the playlists a backup would include, with the track counts
+// Spotify reports for them, without fetching any tracks. target is where the
+// run would be written.
+func printPlan(ctx context.Context, client *SpotifyClient, target string) error {
+	var playlists []Playlist
+	if !*skipPlaylists {
+		var err error
+		playlists, err = client.fetchPlaylists(ctx, *userFlag)
 		if err != nil {
-			return nil, errors.Wrap(err, "failed to fetch saved tracks")
+			return err
 		}
-		data, err := ioutil.ReadAll(resp.Body)
+
+		playlists, err = filterPlaylists(playlists, *playlistNames, *playlistRegex)
 		if err != nil {
-			resp.Body.Close()
-			return nil, errors.Wrap(err, "failed to read saved tracks response")
+			return err
 		}
-		var savedTracksPage TracksPage
-		json.Unmarshal(data, &savedTracksPage)
-		tracks = append(tracks, savedTracksPage.Items...)
+		playlists = filterVisibility(playlists, *onlyPublic, *onlyPrivate, *skipCollab)
+		playlists = limitPlaylists(playlists, *limitFlag)
+	}
 
-		if len(savedTracksPage.Items) < limit {
-			break
+	savedTracks := 0
+	if !*skipSaved {
+		var err error
+		savedTracks, err = client.fetchSavedTracksTotal(ctx)
+		if err != nil {
+			return err
 		}
-		fmt.Printf("Fetched %d saved tracks\n", len(tracks))
-		nextPageUrl = savedTracksPage.Next
-		resp.Body.Close()
 	}
 
-	return tracks, nil
+	total := 0
+	if len(playlists) > 0 {
+		fmt.Println("Playlists that would be backed up:")
+	}
+	for _, p := range playlists {
+		fmt.Printf("  %s (%d tracks)\n", p.Name, p.Tracks.Total)
+		total += p.Tracks.Total
+	}
+	fmt.Printf("%d playlists with %d tracks, and %d saved tracks\n", len(playlists), total, savedTracks)
+	fmt.Printf("Backup would be written to %s\n", target)
+
+	return nil
+}
+
+// interrupted ends a cancelled run. The playlists that were completely
+// fetched are kept, and the manifest records that the backup is incomplete.
+func interrupted(ctx context.Context, runDir string, manifest *Manifest) error {
+	manifest.Incomplete = true
+	if err := writeManifest(runDir, manifest); err != nil {
+		slog.Error("Error writing manifest", "error", err)
+	}
+	slog.Info("Run again with -resume to continue this backup", "dir", runDir, "playlists", manifest.TotalPlaylists)
+
+	return errors.Wrap(ctx.Err(), "backup interrupted")
 }
 
-func saveJSONToFile(name string, data interface{}) {
-	jsonData, err := json.MarshalIndent(data, "", "  ")
+func main() {
+	parseCommandLine()
+
+	// Load the .env file, if there is one. The variables can also be set in
+	// the environment directly. It's loaded before the config file, which
+	// only fills in what the environment doesn't set.
+	envErr := godotenv.Load()
+
+	if *configFile != "" {
+		if err := loadConfig(*configFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if err := setupLogging(*logLevel, *colorFlag); err != nil {
+		log.Fatal(err)
+	}
+
+	if os.IsNotExist(envErr) {
+		slog.Debug("No .env file found, using the environment")
+	} else if envErr != nil {
+		log.Fatalf("Error loading .env file: %v", envErr)
+	}
+
+	// Cancel all requests on Ctrl-C or SIGTERM.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if *interval > 0 {
+		if *restoreDir != "" || *verifyDir != "" || *diffMode || *serveDir != "" || *dryRun {
+			log.Print("-interval only repeats backups, so it can't be used with -restore, -verify, -diff, -serve or -dry-run")
+			os.Exit(exitUsage)
+		}
+		if *metricsPort > 0 {
+			if err := serveMetrics(ctx, *metricsPort); err != nil {
+				log.Fatal(err)
+			}
+		}
+		runEvery(ctx, *interval)
+		return
+	}
+	if *metricsPort > 0 {
+		log.Print("-metrics-port needs -interval, since a single backup has finished before it can be scraped")
+		os.Exit(exitUsage)
+	}
+
+	if err := runOnce(ctx); err != nil {
+		log.Print(err)
+		os.Exit(exitCode(err))
+	}
+}
+
+// runOnce makes a single backup, cancelled when the -timeout expires, and
+// sends a notification if it fails.
+func runOnce(ctx context.Context) error {
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+
+	err := run(ctx)
+	var incomplete *incompleteError
+	if err != nil && !errors.As(err, &incomplete) {
+		status := "failed"
+		if ctx.Err() != nil {
+			status = "interrupted"
+		}
+		runNotifier.send(status, 0, err)
+	}
+
+	return err
+}
+
+// run makes a backup, or does what the options ask for instead, returning
+// the first error that ends it instead of exiting.
+func run(ctx context.Context) error {
+	if *notifyURL != "" {
+		runNotifier = &notifier{url: *notifyURL, started: time.Now()}
+	}
+
+	if *compactFlag && isFlagSet("indent") {
+		return errors.New("-compact writes JSON without indentation, so it can't be used with -indent")
+	}
+	indent, err := parseIndent(*indentFlag)
 	if err != nil {
-		log.Fatalf("Error marshaling JSON data: %v", err)
+		return err
+	}
+	jsonIndent = indent
+	compactJSON = *compactFlag
+
+	httpClient, err = newHTTPClient(*proxyFlag, *userAgent)
+	if err != nil {
+		return err
+	}
+
+	// Verifying, comparing and browsing backups work on the files alone and
+	// need no login.
+	if *verifyDir != "" {
+		// Only for the warning about newer formats; the checksums cover
+		// whatever files the backup has.
+		if _, err := readManifest(*verifyDir); err != nil {
+			slog.Warn("Error reading manifest", "error", err)
+		}
+		problems, err := verifyChecksums(*verifyDir)
+		if err != nil {
+			return err
+		}
+		if problems > 0 {
+			return errors.Errorf("backup in %s failed verification with %d problems", *verifyDir, problems)
+		}
+		slog.Log(ctx, levelSuccess, "Backup verified", "dir", *verifyDir)
+		return nil
+	}
+
+	if *diffMode {
+		if len(cmdArgs) != 2 {
+			return errors.New("-diff needs two backup folders: -diff <old> <new>")
+		}
+		return diffBackups(cmdArgs[0], cmdArgs[1])
+	}
+
+	if *serveDir != "" {
+		return serveBackup(ctx, *serveDir, *servePort)
+	}
+
+	if missing := missingEnv(); len(missing) > 0 {
+		fmt.Fprint(os.Stderr, credentialsHelp(missing))
+		return errors.New("missing Spotify credentials")
 	}
 
-	backupFolder := "backups"
-	if _, err := os.Stat(backupFolder); os.IsNotExist(err) {
-		err = os.Mkdir(backupFolder, 0755)
+	format := *formatFlag
+	if format == "" {
+		format = os.Getenv("BACKUP_FORMAT")
+	}
+	if format != "" {
+		formats, err = parseFormats(format)
 		if err != nil {
-			log.Fatalf("Error creating backups folder: %v", err)
+			return err
 		}
 	}
 
-	cleanedFilename := filepath.Clean(name)
-	safeFilename := regexp.MustCompile(`[^a-zA-Z0-9_]+`).ReplaceAllString(cleanedFilename, "-")
+	var since time.Time
+	if *sinceFlag != "" {
+		since, err = parseSince(*sinceFlag)
+		if err != nil {
+			return err
+		}
+	}
 
-	filename := fmt.Sprintf("%s/%s.json", backupFolder, safeFilename)
-	err = ioutil.WriteFile(filename, jsonData, 0644)
+	backupFolder := *outputFlag
+	if backupFolder == "" {
+		backupFolder = os.Getenv("BACKUP_DIR")
+	}
+	if backupFolder == "" {
+		backupFolder = defaultBackupFolder
+	}
+	bucket, prefix, toS3, err := parseS3URL(backupFolder)
 	if err != nil {
-		log.Fatalf("Error writing JSON data to file: %v", err)
+		return err
+	}
+	if *profileFlag != "" {
+		if sanitizeFilename(*profileFlag) != *profileFlag {
+			return errors.Errorf("invalid profile %q: it's used in file names, so it can't contain characters like / or :", *profileFlag)
+		}
+		backupFolder = filepath.Join(backupFolder, *profileFlag)
+		prefix = path.Join(prefix, *profileFlag)
+	}
+	if *userFlag != "" {
+		if *skipPlaylists {
+			return errors.New("-user only backs up playlists, so it can't be used with -skip-playlists")
+		}
+		// Saved tracks, shows and episodes can only be read for the logged in user.
+		*skipSaved = true
+	}
+	var resumed *previousBackup
+	if *resumeDir != "" {
+		if toS3 {
+			return errors.New("-resume only works with a local -output")
+		}
+		if err := checkResumeDir(backupFolder, *resumeDir); err != nil {
+			return err
+		}
+		resumed, err = loadBackup(*resumeDir)
+		if err != nil {
+			return errors.Wrap(err, "failed to load backup to resume")
+		}
+	}
+	if *keepRuns < 0 || *maxAge < 0 {
+		return errors.New("-keep and -max-age can't be negative")
+	}
+	if *maxTracks < 0 {
+		return errors.Errorf("invalid -max-tracks-per-playlist %d: expected 0 or more", *maxTracks)
+	}
+	if *limitFlag < 0 {
+		return errors.Errorf("invalid -limit-playlists %d: expected 0 or more", *limitFlag)
+	}
+	if *byYearPlaylists && !*byYear {
+		return errors.New("-by-year-playlists adds playlist tracks to the -by-year export, so it needs -by-year")
+	}
+	if *onlyPublic && *onlyPrivate {
+		return errors.New("-only-public and -only-private together leave no playlists to back up")
+	}
+	if *publicOnly {
+		switch {
+		case *userFlag == "":
+			return errors.New("-public-only can only back up the public playlists of a -user")
+		case *restoreDir != "":
+			return errors.New("-public-only can't restore, since restoring needs a login")
+		case *marketFlag == "from_token":
+			return errors.New("-market from_token needs a login, so it can't be used with -public-only")
+		case os.Getenv("SPOTIFY_CLIENT_SECRET") == "":
+			return errors.New("-public-only needs SPOTIFY_CLIENT_SECRET, since the app logs in as itself")
+		}
+	}
+	if *maxConcurrency > 0 && (*minConcurrency < 1 || *minConcurrency > *maxConcurrency) {
+		return errors.Errorf("invalid -min-concurrency %d: expected between 1 and -max-concurrency", *minConcurrency)
+	}
+	if *addedByFlag != "" && *skipCollab {
+		return errors.New("-added-by only backs up collaborative playlists, so it can't be used with -skip-collaborative")
+	}
+	if *skipPlaylists && *skipSaved {
+		return errors.New("-skip-playlists and -skip-saved together leave nothing to back up")
+	}
+	if err := checkMarket(*marketFlag); err != nil {
+		return err
+	}
+	if *dedupBy != dedupById && *dedupBy != dedupByIsrc {
+		return errors.Errorf("invalid -dedup-by %q: expected id or isrc", *dedupBy)
+	}
+	if *restoreMode != restoreCreate && *restoreMode != restoreReplace && *restoreMode != restoreAppend {
+		return errors.Errorf("invalid restore mode %q: expected create, replace or append", *restoreMode)
+	}
+	if *archiveFormat != "" && *archiveFormat != archiveZip && *archiveFormat != archiveTarGz {
+		return errors.Errorf("invalid archive format %q: expected zip or targz", *archiveFormat)
 	}
-}
 
-func main() {
-	// Load the .env file
-	err := godotenv.Load()
+	// Backups to S3 are written straight to the bucket, with the prefix in
+	// place of the backup folder.
+	if toS3 && *restoreDir == "" && !*dryRun {
+		if *keepRuns > 0 || *maxAge > 0 {
+			return errors.New("-keep and -max-age only work with a local -output")
+		}
+		bucketStorage, err := newS3Storage(ctx, bucket)
+		if err != nil {
+			return err
+		}
+		defer func(previous Storage) { storage = previous }(storage)
+		storage = bucketStorage
+		backupFolder = prefix
+	}
+
+	if *restoreDir == "" && !*dryRun {
+		if err := checkWritable(backupFolder); err != nil {
+			return errors.Wrap(err, "failed to check backup folder")
+		}
+	}
+
+	tokenPath = *tokenPathFlag
+	if tokenPath == "" {
+		tokenPath = defaultTokenPath(*profileFlag)
+	}
+
+	redirectURL, callbackAddr, callbackPath, err := callbackConfig()
 	if err != nil {
-		log.Fatal("Error loading .env file")
+		return err
+	}
+
+	if *restoreDir != "" {
+		scopes = append(scopes, restoreScopes...)
 	}
 
 	conf := &oauth2.Config{
@@ -306,40 +1397,430 @@ func main() {
 		},
 	}
 
-	ctx := context.Background()
+	// Public clients using PKCE have no secret and send their client id in the
+	// request body instead.
+	if conf.ClientSecret == "" {
+		conf.Endpoint.AuthStyle = oauth2.AuthStyleInParams
+	}
+
+	// Route the token requests through the proxy too. The API client is
+	// built on the same client by oauth2.NewClient.
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, httpClient)
 
-	// Load cached token or start OAuth flow.
-	token, err := loadToken()
-	if err != nil {
-		token = oauthFlow(ctx, conf)
-		saveToken(token)
+	var tokenSource oauth2.TokenSource
+	if *publicOnly {
+		tokenSource = appTokenSource(ctx, conf)
+	} else {
+		tokenSource, err = userTokenSource(ctx, conf, callbackAddr, callbackPath)
+		if err != nil {
+			return err
+		}
 	}
 
-	client := conf.Client(ctx, token)
+	client := NewSpotifyClient(oauth2.NewClient(ctx, tokenSource), rate.NewLimiter(rate.Limit(*rps), 1))
+	client.market = *marketFlag
+	client.includeEpisodes = *includeEpisodes
+	client.includeMarkets = *includeMarkets
+	client.parallelPages = *parallelPages
+	workers := *concurrency
+	if *maxConcurrency > 0 {
+		client.adaptive = newAdaptiveConcurrency(*concurrency, *minConcurrency, *maxConcurrency)
+		workers = *maxConcurrency
+	}
 
-	// Fetch playlists.
-	playlists, err := fetchPlaylists(client)
-	if err != nil {
-		log.Fatalf("Error fetching playlists: %v", err)
+	// There is no user without a login, and -public-only always has -user.
+	var user *User
+	if !*publicOnly {
+		user, err = client.fetchCurrentUser(ctx)
+		if err != nil {
+			return err
+		}
 	}
 
-	// Fetch and save tracks for each playlist.
-	for _, p := range playlists {
-		tracks, err := fetchPlaylistTracks(client, p)
+	if *restoreDir != "" {
+		if err := restoreBackup(ctx, client, *restoreDir, user.Id, *restoreMode); err != nil {
+			return errors.Wrap(err, "failed to restore backup")
+		}
+		return nil
+	}
+
+	if *dryRun {
+		target := filepath.Join(backupFolder, time.Now().Format(runDirLayout))
+		if toS3 {
+			target = "s3://" + bucket + "/" + path.Join(prefix, time.Now().Format(runDirLayout))
+		}
+		if err := printPlan(ctx, client, target); err != nil {
+			return errors.Wrap(err, "failed to plan backup")
+		}
+		return nil
+	}
+
+	client.maxTracks = *maxTracks
+
+	started := time.Now()
+	runDir := *resumeDir
+	if runDir == "" {
+		runDir, err = createRunDir(backupFolder, started)
+		if err != nil {
+			return errors.Wrap(err, "failed to create backup folder")
+		}
+	}
+	slog.Info("Writing backup", "dir", runDir)
+	manifestUser := *userFlag
+	if manifestUser == "" {
+		manifestUser = user.Id
+	}
+	if *anonymize {
+		manifestUser = anonymousId(manifestUser)
+	}
+	manifest := newManifest(started, manifestUser)
+	runNotifier.start(runDir, manifest)
+	if !*anonymize && user != nil {
+		manifest.Profile = user
+		if _, err := saveJSONToFile(runDir, "profile", user); err != nil {
+			return err
+		}
+	}
+
+	// Fetch playlists.
+	var playlists []Playlist
+	if !*skipPlaylists {
+		playlists, err = client.fetchPlaylists(ctx, *userFlag)
+		if err != nil {
+			return err
+		}
+
+		playlists, err = filterPlaylists(playlists, *playlistNames, *playlistRegex)
 		if err != nil {
-			log.Printf("Error fetching tracks for playlist %s: %v", p.Name, err)
+			return err
+		}
+		playlists = filterVisibility(playlists, *onlyPublic, *onlyPrivate, *skipCollab)
+		playlists = limitPlaylists(playlists, *limitFlag)
+
+		// Spotify's order isn't guaranteed to be the same between runs. Sort
+		// by id so an unchanged library gives byte-identical files, with the
+		// same suffixes for playlists whose names collide.
+		sort.SliceStable(playlists, func(i, j int) bool { return playlists[i].Id < playlists[j].Id })
+	}
+
+	// Followers change without changing the snapshot id, so the details are
+	// fetched for unchanged playlists too.
+	if *playlistDetails {
+		client.addPlaylistDetails(ctx, playlists)
+	}
+
+	// Reuse the previous backup of playlists whose snapshot id hasn't changed.
+	// Latest is never linked to a -since backup, so reused tracks are complete
+	// and filtered below like fetched ones. When resuming, the playlists
+	// already written to the run folder are reused instead.
+	previous := resumed
+	if previous == nil && !*fullBackup {
+		previous, err = loadPreviousBackup(backupFolder)
+		if err != nil && !os.IsNotExist(errors.Cause(err)) {
+			slog.Warn("Error loading previous backup, fetching all playlists", "error", err)
+		}
+	}
+
+	results := make([]playlistResult, len(playlists))
+	var toFetch []Playlist
+	var toFetchIndex []int
+	for i, p := range playlists {
+		items, ok := previous.unchanged(p)
+		var episodes []PlaylistEpisode
+		if ok && *includeEpisodes {
+			episodes, ok = previous.episodes(p)
+		}
+		if ok {
+			slog.Info("Playlist is unchanged since the last backup", "playlist", p.Name)
+			results[i] = playlistResult{Playlist: p, Items: items, Episodes: episodes}
 			continue
 		}
+		toFetch = append(toFetch, p)
+		toFetchIndex = append(toFetchIndex, i)
+	}
+	progress = newProgressBar(len(toFetch))
+	for i, result := range client.fetchAllPlaylistTracks(ctx, toFetch, workers) {
+		results[toFetchIndex[i]] = result
+	}
+	progress.finish()
+	progress = nil
+	if *retryFailed {
+		client.retryFailedPlaylists(ctx, results)
+	}
+
+	// Save tracks for each playlist.
+	var playlistTracks []Item
+	var contributors []PlaylistContributors
+	duplicates := make([]DuplicateTrack, 0)
+	allTracks := make(map[string]*TrackWithSources)
+	isrcs := make(map[string]*IsrcEntry)
+	missingIsrcs := 0
+	albums := make(map[string]Album)
+	var failed []playlistResult
+	namer := newFileNamer()
+	for _, result := range results {
+		p, tracks := result.Playlist, result.Items
+		if result.Err != nil && isNotFound(result.Err) {
+			slog.Warn("Playlist was deleted during the backup, skipping", "playlist", p.Name)
+			manifest.addGone(p)
+			continue
+		}
+		if result.Err != nil {
+			failed = append(failed, result)
+			continue
+		}
+
+		if !since.IsZero() {
+			tracks = filterSince(tracks, since, *sinceUndated)
+		}
+		if *addedByFlag != "" {
+			if !p.Collaborative {
+				slog.Info("Skipping playlist that isn't collaborative", "playlist", p.Name, "added_by", *addedByFlag)
+				continue
+			}
+			tracks = filterAddedBy(tracks, *addedByFlag)
+		}
+
+		if *anonymize {
+			p = anonymizePlaylist(p)
+			anonymizeItems(tracks)
+			anonymizeEpisodes(result.Episodes)
+		}
 
-		saveJSONToFile(p.Name, tracks)
-		time.Sleep(2 * time.Second) // Avoid rate limiting. Can probably be tuned
+		if *audioFeatures {
+			if err := client.addAudioFeatures(ctx, tracks); err != nil {
+				slog.Error("Error fetching audio features", "playlist", p.Name, "error", err)
+			}
+		}
+
+		name := namer.name(p.Name, p.Id)
+		files, err := saveItems(runDir, name, p.Name, tracks)
+		if err != nil {
+			return err
+		}
+		metaFile, err := savePlaylistMetadata(runDir, name, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, metaFile)
+		if *includeEpisodes {
+			episodesFile, err := savePlaylistEpisodes(runDir, name, result.Episodes)
+			if err != nil {
+				return err
+			}
+			files = append(files, episodesFile)
+		}
+		if *summaries {
+			summaryFile := backupFilePath(runDir, name, "summary.json")
+			if err := writeJSON(summaryFile, summarizePlaylist(p, tracks)); err != nil {
+				return err
+			}
+			files = append(files, summaryFile)
+		}
+		manifest.addPlaylist(p, tracks, result.Truncated, files)
+		if *reportDups {
+			duplicates = append(duplicates, findDuplicates(p, tracks)...)
+		}
+		if *combined {
+			addToCombined(allTracks, p.Name, tracks, *dedupBy == dedupByIsrc)
+		}
+		if *isrcIndex {
+			missingIsrcs += addToIsrcIndex(isrcs, p.Name, tracks)
+		}
+		if *reportContribs && p.Collaborative {
+			contributors = append(contributors, countContributors(p, tracks))
+		}
+		if *byYearPlaylists {
+			playlistTracks = append(playlistTracks, tracks...)
+		}
+		if *downloadArt {
+			addAlbums(albums, tracks)
+		}
 	}
 
-	// Fetch saved tracks.
-	savedTracks, err := fetchSavedTracks(client)
-	if err != nil {
-		log.Fatalf("Error fetching saved tracks: %v", err)
+	if ctx.Err() != nil {
+		return interrupted(ctx, runDir, manifest)
+	}
+
+	for _, result := range failed {
+		slog.Error("Error fetching tracks", "playlist", result.Playlist.Name, "error", result.Err)
+	}
+	if len(failed) > 0 {
+		if _, err := saveJSONToFile(runDir, "failed", failedPlaylists(failed)); err != nil {
+			return err
+		}
 	}
 
-	saveJSONToFile("saved_tracks", savedTracks)
+	// missing names the optional parts of the backup that couldn't be
+	// fetched, which make it incomplete like failed playlists do.
+	var missing []string
+	var savedTracks []Item
+	if !*skipSaved {
+		// Fetch saved tracks.
+		savedTracks, err = client.fetchSavedTracks(ctx)
+		if err != nil && ctx.Err() != nil {
+			return interrupted(ctx, runDir, manifest)
+		}
+		if err != nil {
+			return err
+		}
+
+		if !since.IsZero() {
+			savedTracks = filterSince(savedTracks, since, *sinceUndated)
+		}
+
+		if *anonymize {
+			anonymizeItems(savedTracks)
+		}
+
+		if *audioFeatures {
+			if err := client.addAudioFeatures(ctx, savedTracks); err != nil {
+				slog.Error("Error fetching audio features for saved tracks", "error", err)
+			}
+		}
+
+		if _, err := saveItems(runDir, "saved_tracks", "Saved tracks", savedTracks); err != nil {
+			return err
+		}
+		manifest.SavedTracks = len(savedTracks)
+
+		// Fetch saved podcasts. These are optional extras, so errors don't stop the backup.
+		shows, err := client.fetchSavedShows(ctx)
+		if err != nil {
+			slog.Error("Error fetching saved shows", "error", err)
+			missing = append(missing, "saved shows")
+		} else if _, err := saveJSONToFile(runDir, "saved_shows", shows); err != nil {
+			return err
+		}
+
+		episodes, err := client.fetchSavedEpisodes(ctx)
+		if err != nil {
+			slog.Error("Error fetching saved episodes", "error", err)
+			missing = append(missing, "saved episodes")
+		} else if _, err := saveJSONToFile(runDir, "saved_episodes", episodes); err != nil {
+			return err
+		}
+	}
+
+	if *reportContribs {
+		if _, err := saveJSONToFile(runDir, "contributors", contributors); err != nil {
+			return err
+		}
+	}
+
+	if *reportDups {
+		if _, err := saveJSONToFile(runDir, "duplicates", duplicates); err != nil {
+			return err
+		}
+	}
+
+	if *combined {
+		addToCombined(allTracks, "", savedTracks, *dedupBy == dedupByIsrc)
+		if _, err := saveJSONToFile(runDir, "all_tracks", allTracks); err != nil {
+			return err
+		}
+	}
+
+	if *isrcIndex {
+		missingIsrcs += addToIsrcIndex(isrcs, "", savedTracks)
+		if _, err := saveJSONToFile(runDir, "isrc_index", isrcs); err != nil {
+			return err
+		}
+		if missingIsrcs > 0 {
+			slog.Info("Some tracks have no ISRC and are left out of the ISRC index", "tracks", missingIsrcs)
+		}
+	}
+
+	if *byYear {
+		if _, err := saveJSONToFile(runDir, "tracks_by_year", groupByYearAdded(append(savedTracks, playlistTracks...))); err != nil {
+			return err
+		}
+	}
+
+	if *downloadArt {
+		addAlbums(albums, savedTracks)
+		previousArt := filepath.Join(backupFolder, latestName, artFolder)
+		if err := downloadAlbumArt(ctx, runDir, previousArt, albums); err != nil {
+			slog.Error("Error downloading album art", "error", err)
+		}
+	}
+
+	if formats[formatHTML] {
+		savedTracksFile := ""
+		if !*skipSaved {
+			savedTracksFile = backupFilePath(runDir, "saved_tracks", "html")
+		}
+		if err := writeHTMLIndex(runDir, manifest, savedTracksFile); err != nil {
+			return err
+		}
+	}
+
+	if err := writeManifest(runDir, manifest); err != nil {
+		return err
+	}
+	report := stats.report(manifest, len(failed), started, runDir)
+	if _, err := saveJSONToFile(runDir, "stats", report); err != nil {
+		return err
+	}
+	lastRun.Store(&finishedRun{report: report, finished: time.Now()})
+	if err := writeChecksums(runDir); err != nil {
+		slog.Error("Error writing checksums", "error", err)
+	}
+
+	archive := ""
+	if *archiveFormat != "" {
+		archive, err = archiveRun(runDir, *archiveFormat)
+		if err != nil {
+			return errors.Wrap(err, "failed to archive backup")
+		}
+		slog.Info("Archived backup", "archive", archive)
+
+		if *archiveCleanup {
+			if err := storage.Remove(runDir); err != nil {
+				slog.Error("Error removing archived backup folder", "error", err)
+			}
+		}
+	}
+
+	switch {
+	case *archiveFormat != "" && *archiveCleanup:
+		// The run folder is gone, so there is nothing to link to.
+	case *skipPlaylists || *skipSaved || *limitFlag > 0 || *addedByFlag != "" || !since.IsZero() ||
+		*playlistNames != "" || *playlistRegex != "" || *onlyPublic || *onlyPrivate || *skipCollab:
+		// A partial backup would hide the skipped part from the next
+		// incremental run and from restores of latest.
+		slog.Info("Not updating the latest backup link for a partial backup")
+	case *anonymize:
+		// Restoring or diffing an anonymized backup loses who added what,
+		// so latest keeps pointing at the last backup with the real ids.
+		slog.Info("Not updating the latest backup link for an anonymized backup")
+	default:
+		if err := updateLatest(backupFolder, runDir); err != nil {
+			slog.Error("Error updating latest backup link", "error", err)
+		}
+	}
+
+	// Only prune after a complete backup, so failures don't eat into the
+	// backups kept.
+	if *keepRuns > 0 || *maxAge > 0 {
+		if len(failed) > 0 {
+			slog.Warn("Not pruning old backups since some playlists failed")
+		} else if err := pruneBackups(backupFolder, runDir, *keepRuns, *maxAge); err != nil {
+			slog.Error("Error pruning old backups", "error", err)
+		}
+	}
+
+	status, level := "succeeded", levelSuccess
+	if len(failed) > 0 || len(missing) > 0 {
+		status, level = "incomplete", slog.LevelWarn
+	}
+	slog.Log(ctx, level, "Backup finished", "dir", runDir, "playlists", manifest.TotalPlaylists, "failed", len(failed),
+		"tracks", manifest.TotalTracks, "saved_tracks", manifest.SavedTracks, "duration", time.Since(started).Round(time.Second))
+	runNotifier.send(status, len(failed), nil)
+
+	if len(failed) > 0 || len(missing) > 0 {
+		return &incompleteError{failed: len(failed), missing: missing}
+	}
+
+	return nil
 }
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+	"golang.org/x/time/rate"
+)
+
+// mockSpotify serves canned Web API responses, looked up by the path and
+// query of each request. {{base}} in a response is replaced with the server's
+// URL, so next links can point back at it. Unknown requests get a 404.
+type mockSpotify struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	responses map[string]string
+	requests  []string
+}
+
+func newMockSpotify(t *testing.T, responses map[string]string) *mockSpotify {
+	t.Helper()
+
+	m := &mockSpotify{responses: responses}
+	m.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		m.requests = append(m.requests, r.URL.RequestURI())
+		body, ok := m.responses[r.URL.RequestURI()]
+		m.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error": {"status": 404, "message": "Not found."}}`)
+			return
+		}
+		fmt.Fprint(w, strings.ReplaceAll(body, "{{base}}", m.URL))
+	}))
+	t.Cleanup(m.Close)
+
+	return m
+}
+
+// client returns a client for the mock server without rate limiting.
+func (m *mockSpotify) client() *SpotifyClient {
+	c := NewSpotifyClient(m.Client(), rate.NewLimiter(rate.Inf, 1))
+	c.baseURL = m.URL
+	return c
+}
+
+func (m *mockSpotify) requestCount() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.requests)
+}
+
+// page is a page of items as returned by the Web API. An empty next is
+// returned as null, like Spotify does on the last page.
+func page(next string, total int, items ...string) string {
+	nextJSON := "null"
+	if next != "" {
+		nextJSON = fmt.Sprintf("%q", next)
+	}
+
+	return fmt.Sprintf(`{"items": [%s], "next": %s, "total": %d}`, strings.Join(items, ", "), nextJSON, total)
+}
+
+func playlistJSON(id string, name string) string {
+	return fmt.Sprintf(`{"id": %q, "name": %q, "snapshot_id": "snap-%s", "owner": {"id": "owner"}, "tracks": {"total": 0}}`, id, name, id)
+}
+
+func trackItemJSON(id string, name string) string {
+	return fmt.Sprintf(`{"added_at": "2024-01-15T10:00:00Z", "track": {"id": %q, "name": %q, "type": "track", "uri": "spotify:track:%s"}}`, id, name, id)
+}
+
+func TestFetchPlaylistsFollowsNext(t *testing.T) {
+	m := newMockSpotify(t, map[string]string{
+		"/v1/me/playlists?offset=0&limit=50": page("{{base}}/v1/me/playlists?offset=2&limit=2", 3, playlistJSON("p1", "One"), playlistJSON("p2", "Two")),
+		"/v1/me/playlists?offset=2&limit=2":  page("", 3, playlistJSON("p3", "Three")),
+	})
+
+	playlists, err := m.client().fetchPlaylists(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []string
+	for _, p := range playlists {
+		ids = append(ids, p.Id)
+	}
+	if got := strings.Join(ids, ","); got != "p1,p2,p3" {
+		t.Errorf("playlists = %s, want p1,p2,p3", got)
+	}
+}
+
+func TestFetchPlaylistsStopsWithoutNext(t *testing.T) {
+	// Total claims more playlists than the page has, but without a next
+	// link there is nothing more to fetch.
+	m := newMockSpotify(t, map[string]string{
+		"/v1/me/playlists?offset=0&limit=50": page("", 10, playlistJSON("p1", "One")),
+	})
+
+	playlists, err := m.client().fetchPlaylists(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(playlists) != 1 {
+		t.Errorf("got %d playlists, want 1", len(playlists))
+	}
+	if n := m.requestCount(); n != 1 {
+		t.Errorf("made %d requests, want 1", n)
+	}
+}
+
+func TestFetchPlaylistsNone(t *testing.T) {
+	m := newMockSpotify(t, map[string]string{
+		"/v1/me/playlists?offset=0&limit=50": page("", 0),
+	})
+
+	playlists, err := m.client().fetchPlaylists(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if playlists == nil || len(playlists) != 0 {
+		t.Errorf("playlists = %#v, want an empty list", playlists)
+	}
+}
+
+func TestFetchPlaylistTracksFollowsNext(t *testing.T) {
+	m := newMockSpotify(t, map[string]string{
+		"/v1/playlists/p1/tracks?offset=0&limit=100": page("{{base}}/v1/playlists/p1/tracks?offset=2&limit=2", 3, trackItemJSON("t1", "One"), trackItemJSON("t2", "Two")),
+		"/v1/playlists/p1/tracks?offset=2&limit=2":   page("", 3, trackItemJSON("t3", "Three")),
+	})
+
+	result := m.client().fetchPlaylistTracks(context.Background(), Playlist{Id: "p1", Name: "Playlist"})
+	if result.Err != nil {
+		t.Fatal(result.Err)
+	}
+
+	if len(result.Items) != 3 {
+		t.Fatalf("got %d tracks, want 3", len(result.Items))
+	}
+	for i, item := range result.Items {
+		if want := fmt.Sprintf("t%d", i+1); item.Track.Id != want || item.Position != i {
+			t.Errorf("item %d = %s at position %d, want %s at position %d", i, item.Track.Id, item.Position, want, i)
+		}
+	}
+}
+
+func TestFetchPlaylistTracksStopsWithoutNext(t *testing.T) {
+	m := newMockSpotify(t, map[string]string{
+		"/v1/playlists/p1/tracks?offset=0&limit=100": page("", 200, trackItemJSON("t1", "One")),
+	})
+
+	result := m.client().fetchPlaylistTracks(context.Background(), Playlist{Id: "p1", Name: "Playlist"})
+	if result.Err != nil {
+		t.Fatal(result.Err)
+	}
+	if len(result.Items) != 1 {
+		t.Errorf("got %d tracks, want 1", len(result.Items))
+	}
+	if n := m.requestCount(); n != 1 {
+		t.Errorf("made %d requests, want 1", n)
+	}
+}
+
+func TestFetchPlaylistTracksEmpty(t *testing.T) {
+	m := newMockSpotify(t, map[string]string{
+		"/v1/playlists/p1/tracks?offset=0&limit=100": page("", 0),
+	})
+
+	result := m.client().fetchPlaylistTracks(context.Background(), Playlist{Id: "p1", Name: "Playlist"})
+	if result.Err != nil {
+		t.Fatal(result.Err)
+	}
+	if result.Items == nil || len(result.Items) != 0 {
+		t.Errorf("items = %#v, want an empty list", result.Items)
+	}
+}
+
+func TestSanitizeFilename(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"Русский рок", "Русский рок"},
+		{"日本語", "日本語"},
+		{"Road trip 🚗🎶", "Road trip 🚗🎶"},
+		{"AC/DC: Best?", "AC-DC- Best-"},
+		{`back\slash <"pipe"|star*>`, `back-slash --pipe--star--`},
+		{"tab\there", "tab-here"},
+		{"CON", "_CON"},
+		{"nul", "_nul"},
+		{"COM1.backup", "_COM1.backup"},
+		{"CONCERTS", "CONCERTS"},
+		{"Mixtape...", "Mixtape"},
+		{"Trailing . ", "Trailing"},
+		{"..", "_"},
+		{"   ", "_"},
+		{"", "_"},
+		{strings.Repeat("日", 100), strings.Repeat("日", 66)},
+		{"a" + strings.Repeat("日", 100), "a" + strings.Repeat("日", 66)},
+		{strings.Repeat("🎶", 60), strings.Repeat("🎶", 50)},
+	}
+	for _, tt := range tests {
+		got := sanitizeFilename(tt.name)
+		if got != tt.want {
+			t.Errorf("sanitizeFilename(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+		if len(got) > maxFilenameBytes || !utf8.ValidString(got) {
+			t.Errorf("sanitizeFilename(%q) = %q is too long or not valid UTF-8", tt.name, got)
+		}
+		if again := sanitizeFilename(got); again != got {
+			t.Errorf("sanitizeFilename(%q) = %q, not stable", got, again)
+		}
+	}
+}
+
+func TestFileNamerCollisions(t *testing.T) {
+	long := strings.Repeat("日", 100)
+	namer := newFileNamer()
+
+	tests := []struct {
+		name   string
+		id     string
+		suffix string
+	}{
+		{"Mix", "37i9dQZF1", ""},
+		{"mix", "4kQovkgB", "-4kQovk"},
+		{"MIX", "4kQovkzz", "-4kQovkzz"},
+		{"saved_tracks", "1a2b3c4d", "-1a2b3c"},
+		{long, "abcdef123", ""},
+		{long, "abcdef456", "-abcdef"},
+		{long, "abcdef789", "-abcdef789"},
+	}
+	seen := make(map[string]bool)
+	for _, tt := range tests {
+		got := namer.name(tt.name, tt.id)
+		if !strings.HasSuffix(got, tt.suffix) {
+			t.Errorf("name(%q, %q) = %q, want suffix %q", tt.name, tt.id, got, tt.suffix)
+		}
+		if len(got) > maxFilenameBytes || !utf8.ValidString(got) {
+			t.Errorf("name(%q, %q) = %q is too long or not valid UTF-8", tt.name, tt.id, got)
+		}
+		if seen[strings.ToLower(got)] {
+			t.Errorf("name(%q, %q) = %q was already handed out", tt.name, tt.id, got)
+		}
+		seen[strings.ToLower(got)] = true
+	}
+}
+
+// trackItems returns n track items with ids prefix0 to prefix<n-1>.
+func trackItems(prefix string, n int) []string {
+	items := make([]string, n)
+	for i := range items {
+		items[i] = trackItemJSON(fmt.Sprintf("%s%d", prefix, i), fmt.Sprintf("Track %d", i))
+	}
+
+	return items
+}
+
+func TestFetchSavedTracksFullLastPage(t *testing.T) {
+	// The last page holds exactly limit tracks, and a page before it is
+	// short, so only next can tell where the tracks end.
+	m := newMockSpotify(t, map[string]string{
+		"/v1/me/tracks?offset=0&limit=50":  page("{{base}}/v1/me/tracks?offset=50&limit=50", 130, trackItems("a", 50)...),
+		"/v1/me/tracks?offset=50&limit=50": page("{{base}}/v1/me/tracks?offset=80&limit=50", 130, trackItems("b", 30)...),
+		"/v1/me/tracks?offset=80&limit=50": page("", 130, trackItems("c", 50)...),
+	})
+
+	tracks, err := m.client().fetchSavedTracks(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tracks) != 130 {
+		t.Fatalf("got %d saved tracks, want 130", len(tracks))
+	}
+	if last := tracks[len(tracks)-1]; last.Track.Id != "c49" || last.Position != 129 {
+		t.Errorf("last track = %s at position %d, want c49 at position 129", last.Track.Id, last.Position)
+	}
+	if n := m.requestCount(); n != 3 {
+		t.Errorf("made %d requests, want 3", n)
+	}
+}
+
+func TestWriteFileAtomicPartialWrite(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "playlist.json")
+	previous := []byte(`[{"position": 0}]`)
+	if err := os.WriteFile(filename, previous, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// More than the write buffer is written before failing, so part of
+	// the new file reaches the disk, as when the disk fills up.
+	errFull := errors.New("no space left on device")
+	err := writeFileAtomic(filename, 0644, func(w io.Writer) error {
+		if _, err := w.Write(bytes.Repeat([]byte("x"), 64*1024)); err != nil {
+			return err
+		}
+		return errFull
+	})
+	if err != errFull {
+		t.Fatalf("writeFileAtomic returned %v, want %v", err, errFull)
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, previous) {
+		t.Errorf("file = %q, want the previous %q", data, previous)
+	}
+	if _, err := os.Stat(filename + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file was left behind: %v", err)
+	}
+}
+
+// withFormats selects the output formats for the rest of a test.
+func withFormats(t *testing.T, selected ...string) {
+	previous := formats
+	formats = make(map[string]bool)
+	for _, format := range selected {
+		formats[format] = true
+	}
+	t.Cleanup(func() { formats = previous })
+}
+
+func TestSerializationIsReproducible(t *testing.T) {
+	withFormats(t, formatJSON, formatCSV, formatM3U, formatHTML, formatNDJSON, formatParquet)
+	items := []Item{
+		{Position: 0, AddedAt: "2024-01-15T10:00:00Z", Track: Track{Id: "t1", Name: "Jóga", Uri: "spotify:track:t1", Artists: []Artist{{Id: "a1", Name: "Björk"}}, ExternalIds: ExternalId{Isrc: "GBAAN9700041"}}},
+		{Position: 1, AddedAt: "2024-01-16T10:00:00Z", Track: Track{Id: "t2", Name: "夜に駆ける", Uri: "spotify:track:t2", Artists: []Artist{{Id: "a2", Name: "YOASOBI"}}}},
+	}
+
+	write := func(reverse bool) string {
+		dir := t.TempDir()
+		if _, err := saveItems(dir, "Playlist", "Playlist", items); err != nil {
+			t.Fatal(err)
+		}
+
+		// Build the combined export in a different map insertion order each
+		// time; the keys are written sorted.
+		all := make(map[string]*TrackWithSources)
+		for i := range items {
+			if reverse {
+				i = len(items) - 1 - i
+			}
+			addToCombined(all, "Playlist", items[i:i+1], false)
+		}
+		if _, err := saveJSONToFile(dir, "all_tracks", all); err != nil {
+			t.Fatal(err)
+		}
+
+		return dir
+	}
+	first, second := write(false), write(true)
+
+	entries, err := os.ReadDir(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 7 {
+		t.Errorf("got %d files, want one per format and all_tracks.json", len(entries))
+	}
+	for _, entry := range entries {
+		a, err := os.ReadFile(filepath.Join(first, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.ReadFile(filepath.Join(second, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(a, b) {
+			t.Errorf("%s differs between two serializations of the same data", entry.Name())
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"log/slog"
+	"path/filepath"
+	"time"
+)
+
+// schemaVersion is the version of the backup format, the files in a run and
+// the fields in them. Bump it whenever the format changes, so readers can tell
+// which format a backup is in. Backups from before it was recorded have
+// version 0, which reads the same as version 1.
+const schemaVersion = 1
+
+// Manifest describes a single backup run and the files it produced.
+type Manifest struct {
+	SchemaVersion  int             `json:"schema_version"`
+	AppVersion     string          `json:"app_version"`
+	Timestamp      string          `json:"timestamp"`
+	UserId         string          `json:"user_id"`
+	Profile        *User           `json:"profile,omitempty"`
+	Scopes         []string        `json:"scopes"`
+	TotalPlaylists int             `json:"total_playlists"`
+	TotalTracks    int             `json:"total_tracks"`
+	SavedTracks    int             `json:"saved_tracks"`
+	Incomplete     bool            `json:"incomplete,omitempty"`
+	Playlists      []ManifestEntry `json:"playlists"`
+	Gone           []ManifestEntry `json:"gone,omitempty"`
+}
+
+type ManifestEntry struct {
+	Name       string   `json:"name"`
+	Id         string   `json:"id"`
+	SnapshotId string   `json:"snapshot_id"`
+	TrackCount int      `json:"track_count"`
+	Truncated  bool     `json:"truncated,omitempty"`
+	Files      []string `json:"files"`
+}
+
+func newManifest(started time.Time, userId string) *Manifest {
+	return &Manifest{
+		SchemaVersion: schemaVersion,
+		AppVersion:    appVersion,
+		Timestamp:     started.Format(time.RFC3339),
+		UserId:        userId,
+		Scopes:        scopes,
+		Playlists:     make([]ManifestEntry, 0),
+	}
+}
+
+// addPlaylist records a playlist backup written to the given files.
+// Truncated playlists were cut short by -max-tracks-per-playlist.
+func (m *Manifest) addPlaylist(playlist Playlist, items []Item, truncated bool, files []string) {
+	names := make([]string, len(files))
+	for i, file := range files {
+		names[i] = filepath.Base(file)
+	}
+
+	m.Playlists = append(m.Playlists, ManifestEntry{
+		Name:       playlist.Name,
+		Id:         playlist.Id,
+		SnapshotId: playlist.SnapshotId,
+		TrackCount: len(items),
+		Truncated:  truncated,
+		Files:      names,
+	})
+	m.TotalPlaylists++
+	m.TotalTracks += len(items)
+}
+
+// addGone records a playlist that was listed but deleted before its tracks
+// could be fetched, so nothing was written for it.
+func (m *Manifest) addGone(playlist Playlist) {
+	m.Gone = append(m.Gone, ManifestEntry{
+		Name:       playlist.Name,
+		Id:         playlist.Id,
+		SnapshotId: playlist.SnapshotId,
+		Files:      make([]string, 0),
+	})
+}
+
+func writeManifest(dir string, manifest *Manifest) error {
+	_, err := saveJSONToFile(dir, "manifest", manifest)
+	return err
+}
+
+// readManifest reads the manifest of the backup run in dir. A backup written
+// in a newer format than this version knows is still read, with a warning
+// that newer files and fields are ignored.
+func readManifest(dir string) (*Manifest, error) {
+	var manifest Manifest
+	if err := readJSON(filepath.Join(dir, "manifest.json"), &manifest); err != nil {
+		return nil, err
+	}
+
+	if manifest.SchemaVersion > schemaVersion {
+		slog.Warn("Backup was written by a newer version, parts of it may be ignored", "dir", dir,
+			"schema_version", manifest.SchemaVersion, "supported", schemaVersion, "app_version", manifest.AppVersion)
+	}
+
+	return &manifest, nil
+}
+
+// previousBackup is the latest earlier run, used to skip fetching playlists
+// that haven't changed since.
+type previousBackup struct {
+	dir     string
+	entries map[string]ManifestEntry
+}
+
+func loadPreviousBackup(root string) (*previousBackup, error) {
+	return loadBackup(filepath.Join(root, latestName))
+}
+
+// loadBackup reads the manifest of the backup run in dir.
+func loadBackup(dir string) (*previousBackup, error) {
+	manifest, err := readManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make(map[string]ManifestEntry, len(manifest.Playlists))
+	for _, entry := range manifest.Playlists {
+		entries[entry.Id] = entry
+	}
+
+	return &previousBackup{dir: dir, entries: entries}, nil
+}
+
+// unchanged returns the previously backed up tracks of playlist if its
+// snapshot id is the same as in the previous run.
+func (b *previousBackup) unchanged(playlist Playlist) ([]Item, bool) {
+	if b == nil || playlist.SnapshotId == "" {
+		return nil, false
+	}
+
+	entry, ok := b.entries[playlist.Id]
+	if !ok || entry.SnapshotId != playlist.SnapshotId || entry.Truncated {
+		return nil, false
+	}
+
+	_, items, err := loadPlaylistBackup(b.dir, entry)
+	if err != nil {
+		return nil, false
+	}
+
+	return items, true
+}
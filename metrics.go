@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// finishedRun is the stats of a backup that has finished, and when it did.
+type finishedRun struct {
+	report   RunStatsReport
+	finished time.Time
+}
+
+// lastRun is the last backup written by this process, served by
+// -metrics-port. It's nil until the first backup has finished.
+var lastRun atomic.Pointer[finishedRun]
+
+// metrics are the gauges of the Prometheus endpoint, one per stats.json
+// counter.
+var metrics = []struct {
+	name  string
+	help  string
+	value func(r RunStatsReport) float64
+}{
+	{"playlists", "Playlists written by the last backup.", func(r RunStatsReport) float64 { return float64(r.Playlists) }},
+	{"failed_playlists", "Playlists the last backup failed to fetch.", func(r RunStatsReport) float64 { return float64(r.FailedPlaylists) }},
+	{"tracks", "Playlist tracks written by the last backup.", func(r RunStatsReport) float64 { return float64(r.Tracks) }},
+	{"saved_tracks", "Saved tracks written by the last backup.", func(r RunStatsReport) float64 { return float64(r.SavedTracks) }},
+	{"api_calls", "Spotify API requests made by the last backup.", func(r RunStatsReport) float64 { return float64(r.APICalls) }},
+	{"retries", "Requests the last backup retried.", func(r RunStatsReport) float64 { return float64(r.Retries) }},
+	{"rate_limited", "Rate-limited responses during the last backup.", func(r RunStatsReport) float64 { return float64(r.RateLimited) }},
+	{"duration_seconds", "How long the last backup took.", func(r RunStatsReport) float64 { return r.DurationSeconds }},
+	{"bytes_written", "Size of the files written by the last backup.", func(r RunStatsReport) float64 { return float64(r.BytesWritten) }},
+}
+
+// writeMetrics writes run in the Prometheus text format.
+func writeMetrics(w io.Writer, run *finishedRun) {
+	gauge := func(name string, help string, value float64) {
+		fmt.Fprintf(w, "# HELP spotify_backup_%s %s\n# TYPE spotify_backup_%s gauge\nspotify_backup_%s %s\n", name, help, name, name, strconv.FormatFloat(value, 'f', -1, 64))
+	}
+
+	gauge("last_finished_timestamp_seconds", "When the last backup finished, as a Unix time.", float64(run.finished.Unix()))
+	for _, m := range metrics {
+		gauge(m.name, m.help, m.value(run.report))
+	}
+}
+
+// metricsHandler serves the stats of the last backup, at /metrics for
+// Prometheus and at /stats.json like the file in the backup.
+func metricsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		// There are no samples until the first backup has finished.
+		if run := lastRun.Load(); run != nil {
+			writeMetrics(w, run)
+		}
+	})
+	mux.HandleFunc("GET /stats.json", func(w http.ResponseWriter, r *http.Request) {
+		run := lastRun.Load()
+		if run == nil {
+			http.Error(w, "no backup has finished yet", http.StatusNotFound)
+			return
+		}
+		writeAPIResponse(w, run.report)
+	})
+
+	return mux
+}
+
+// serveMetrics serves the stats of the last backup on localhost:port until
+// ctx is done. It only returns an error if the port can't be listened on.
+func serveMetrics(ctx context.Context, port int) error {
+	listener, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		return errors.Wrap(err, "failed to listen for metrics")
+	}
+
+	srv := &http.Server{Handler: metricsHandler()}
+	go func() {
+		if err := srv.Serve(listener); err != nil && err != http.ErrServerClosed {
+			slog.Error("Metrics server failed", "error", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	slog.Info("Serving metrics", "url", fmt.Sprintf("http://localhost:%d/metrics", port))
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	previous := lastRun.Load()
+	t.Cleanup(func() { lastRun.Store(previous) })
+	lastRun.Store(nil)
+
+	srv := httptest.NewServer(metricsHandler())
+	t.Cleanup(srv.Close)
+	get := func(path string) (int, string) {
+		t.Helper()
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, string(body)
+	}
+
+	if status, body := get("/metrics"); status != http.StatusOK || body != "" {
+		t.Errorf("/metrics before a backup = %d %q, want an empty 200", status, body)
+	}
+	if status, _ := get("/stats.json"); status != http.StatusNotFound {
+		t.Errorf("/stats.json before a backup = %d, want 404", status)
+	}
+
+	report := RunStatsReport{Playlists: 3, Tracks: 5, SavedTracks: 1, APICalls: 12, DurationSeconds: 1.5, BytesWritten: 12345678}
+	lastRun.Store(&finishedRun{report: report, finished: time.Unix(1705329005, 0)})
+
+	_, body := get("/metrics")
+	for _, want := range []string{
+		"# TYPE spotify_backup_tracks gauge\nspotify_backup_tracks 5\n",
+		"spotify_backup_api_calls 12\n",
+		"spotify_backup_duration_seconds 1.5\n",
+		"spotify_backup_bytes_written 12345678\n",
+		"spotify_backup_failed_playlists 0\n",
+		"spotify_backup_last_finished_timestamp_seconds 1705329005\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("/metrics is missing %q:\n%s", want, body)
+		}
+	}
+
+	status, body := get("/stats.json")
+	var got RunStatsReport
+	if err := json.Unmarshal([]byte(body), &got); err != nil || status != http.StatusOK {
+		t.Fatalf("/stats.json = %d %q: %v", status, body, err)
+	}
+	if got != report {
+		t.Errorf("/stats.json = %+v, want %+v", got, report)
+	}
+}
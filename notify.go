@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const notifyTimeout = 10 * time.Second
+
+// runNotifier posts the result of the run to -notify-url. It is nil when no
+// URL is set, and all methods are safe to call on a nil notifier.
+var runNotifier *notifier
+
+type notifier struct {
+	url      string
+	started  time.Time
+	runDir   string
+	manifest *Manifest
+}
+
+// notification is the webhook payload. The summary is sent as both text
+// (Slack) and content (Discord), so it can be posted to either directly.
+type notification struct {
+	Status  string `json:"status"`
+	Text    string `json:"text"`
+	Content string `json:"content"`
+	Error   string `json:"error,omitempty"`
+	RunStatsReport
+}
+
+// start records the run folder and manifest, so later notifications include
+// what has been backed up so far.
+func (n *notifier) start(runDir string, manifest *Manifest) {
+	if n == nil {
+		return
+	}
+
+	n.runDir, n.manifest = runDir, manifest
+}
+
+// send posts the final status of the run. Failing to notify doesn't affect
+// the backup, so errors are only logged.
+func (n *notifier) send(status string, failed int, cause error) {
+	if n == nil {
+		return
+	}
+
+	manifest := n.manifest
+	if manifest == nil {
+		manifest = &Manifest{}
+	}
+
+	payload := notification{
+		Status:         status,
+		RunStatsReport: stats.report(manifest, failed, n.started, n.runDir),
+	}
+	payload.Text = fmt.Sprintf("Spotify backup %s: %d playlists (%d failed), %d tracks and %d saved tracks in %s",
+		status, payload.Playlists, failed, payload.Tracks, payload.SavedTracks, time.Since(n.started).Round(time.Second))
+	if cause != nil {
+		payload.Error = cause.Error()
+		payload.Text += ": " + payload.Error
+	}
+	payload.Content = payload.Text
+
+	if err := postNotification(n.url, payload); err != nil {
+		slog.Warn("Error sending notification", "error", err)
+	}
+}
+
+func postNotification(url string, payload notification) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal notification")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "failed to create request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "request failed")
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("webhook returned %s", resp.Status)
+	}
+
+	return nil
+}
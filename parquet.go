@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/pkg/errors"
+)
+
+const formatParquet = "parquet"
+
+// parquetRow is one row of a Parquet file. The schema is flat, so the
+// artists are joined into one string as in the CSV files. ArtistIds is only
+// set with -flatten-artists.
+type parquetRow struct {
+	Id          string `parquet:"id"`
+	Name        string `parquet:"name"`
+	ArtistNames string `parquet:"artist_names"`
+	ArtistIds   string `parquet:"artist_ids,optional"`
+	Album       string `parquet:"album"`
+	AddedAt     string `parquet:"added_at"`
+	DurationMs  int64  `parquet:"duration_ms"`
+	Isrc        string `parquet:"isrc"`
+	Popularity  int32  `parquet:"popularity"`
+	Explicit    bool   `parquet:"explicit"`
+}
+
+func saveParquetToFile(dir string, name string, items []Item) (string, error) {
+	filename := backupFilePath(dir, name, "parquet")
+	rows := make([]parquetRow, len(items))
+	for i, item := range items {
+		rows[i] = parquetRecord(item)
+	}
+
+	err := storage.Create(filename, func(out io.Writer) error {
+		w := parquet.NewGenericWriter[parquetRow](out)
+		if _, err := w.Write(rows); err != nil {
+			return err
+		}
+		return w.Close()
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "failed to write Parquet file")
+	}
+
+	return filename, nil
+}
+
+func parquetRecord(item Item) parquetRow {
+	track := item.Track
+	names, ids := tabularArtists(track.Artists)
+	return parquetRow{
+		Id:          track.Id,
+		Name:        track.Name,
+		ArtistNames: names,
+		ArtistIds:   ids,
+		Album:       track.Album.Name,
+		AddedAt:     item.AddedAt,
+		DurationMs:  int64(track.DurationMs),
+		Isrc:        track.ExternalIds.Isrc,
+		Popularity:  int32(track.Popularity),
+		Explicit:    track.Explicit,
+	}
+}
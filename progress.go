@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/term"
+)
+
+const progressWidth = 30
+
+// progress is the progress bar shown while playlists are fetched. It is only
+// shown when stderr is a terminal, so logs redirected to a file stay clean.
+// While it is active, per-page logging is suppressed.
+var progress *progressBar
+
+type progressBar struct {
+	mu      sync.Mutex
+	out     io.Writer
+	total   int
+	done    int
+	started time.Time
+}
+
+// newProgressBar returns a progress bar for total playlists, or nil when it
+// shouldn't be shown. All methods are safe to call on a nil bar.
+func newProgressBar(total int) *progressBar {
+	if *quiet || total == 0 || !term.IsTerminal(int(os.Stderr.Fd())) {
+		return nil
+	}
+
+	p := &progressBar{out: os.Stderr, total: total, started: time.Now()}
+	p.render()
+	return p
+}
+
+// increment marks one more playlist as done.
+func (p *progressBar) increment() {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done++
+	p.render()
+}
+
+// finish ends the progress bar line.
+func (p *progressBar) finish() {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fmt.Fprintln(p.out)
+}
+
+func (p *progressBar) render() {
+	filled := progressWidth * p.done / p.total
+	bar := strings.Repeat("#", filled) + strings.Repeat("-", progressWidth-filled)
+
+	eta := "--"
+	if p.done > 0 {
+		perPlaylist := time.Since(p.started) / time.Duration(p.done)
+		eta = (perPlaylist * time.Duration(p.total-p.done)).Round(time.Second).String()
+	}
+
+	// Pad with spaces to overwrite a longer previous line.
+	fmt.Fprintf(p.out, "\r[%s] Playlist %d of %d, ETA %s   ", bar, p.done, p.total, eta)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/pkg/errors"
+)
+
+// defaultUserAgent identifies the program to Spotify, and to the servers art
+// and notifications are sent to.
+const defaultUserAgent = "spotify-playlist-backup/" + appVersion
+
+// httpClient sends every request the program makes: to Spotify, for album
+// art and for notifications. It goes through the -proxy, or the proxy in
+// HTTPS_PROXY, HTTP_PROXY and NO_PROXY. Uploads to S3 use the same proxy.
+var httpClient = http.DefaultClient
+
+// newHTTPClient returns a client using proxy, or the proxy from the
+// environment if it's empty, that sends userAgent with every request.
+func newHTTPClient(proxy string, userAgent string) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+
+	if proxy != "" {
+		u, err := url.Parse(proxy)
+		if err != nil || u.Host == "" {
+			return nil, errors.Errorf("invalid proxy %q: expected a URL such as http://proxy.example.com:3128", proxy)
+		}
+		transport.Proxy = http.ProxyURL(u)
+	}
+
+	return &http.Client{Transport: &userAgentTransport{base: transport, userAgent: userAgent}}, nil
+}
+
+// userAgentTransport sets the User-Agent header of each request, unless it
+// already has one.
+type userAgentTransport struct {
+	base      *http.Transport
+	userAgent string
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("User-Agent") != "" {
+		return t.base.RoundTrip(req)
+	}
+
+	// A RoundTripper mustn't modify the request it's given.
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", t.userAgent)
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"time"
+)
+
+type PlaylistContributors struct {
+	Playlist     string         `json:"playlist"`
+	PlaylistId   string         `json:"playlist_id"`
+	Contributors map[string]int `json:"contributors"`
+}
+
+type DuplicateTrack struct {
+	Playlist   string `json:"playlist"`
+	PlaylistId string `json:"playlist_id"`
+	Track      string `json:"track"`
+	Artists    string `json:"artists"`
+	TrackId    string `json:"track_id,omitempty"`
+	Isrc       string `json:"isrc,omitempty"`
+	Count      int    `json:"count"`
+}
+
+// unknownYear is the bucket used for items without a usable added_at.
+const unknownYear = "unknown"
+
+// groupByYearAdded buckets items by the year they were added. Items with a
+// missing or unparseable added_at end up in the "unknown" bucket.
+func groupByYearAdded(items []Item) map[string][]Item {
+	buckets := make(map[string][]Item)
+	for _, item := range items {
+		year := unknownYear
+		if addedAt, err := time.Parse(time.RFC3339, item.AddedAt); err == nil {
+			year = addedAt.Format("2006")
+		}
+		buckets[year] = append(buckets[year], item)
+	}
+
+	return buckets
+}
+
+// countContributors tallies how many of the items each user added. Items
+// without an added_by user are counted under "unknown".
+func countContributors(playlist Playlist, items []Item) PlaylistContributors {
+	counts := make(map[string]int)
+	for _, item := range items {
+		id := "unknown"
+		if item.AddedBy != nil && item.AddedBy.Id != "" {
+			id = item.AddedBy.Id
+		}
+		counts[id]++
+	}
+
+	return PlaylistContributors{
+		Playlist:     playlist.Name,
+		PlaylistId:   playlist.Id,
+		Contributors: counts,
+	}
+}
+
+// findDuplicates lists the tracks that appear more than once in a playlist.
+// Tracks are matched by ISRC, so different releases of the same recording
+// count as duplicates, then by track id. Local tracks have neither and are
+// matched by name and artists.
+func findDuplicates(playlist Playlist, items []Item) []DuplicateTrack {
+	var order []string
+	groups := make(map[string][]Item)
+	for _, item := range items {
+		key := duplicateKey(item.Track)
+		if _, ok := groups[key]; !ok {
+			order = append(order, key)
+		}
+		groups[key] = append(groups[key], item)
+	}
+
+	duplicates := make([]DuplicateTrack, 0)
+	for _, key := range order {
+		group := groups[key]
+		if len(group) < 2 {
+			continue
+		}
+
+		track := group[0].Track
+		duplicates = append(duplicates, DuplicateTrack{
+			Playlist:   playlist.Name,
+			PlaylistId: playlist.Id,
+			Track:      track.Name,
+			Artists:    artistNames(track.Artists, ", "),
+			TrackId:    track.Id,
+			Isrc:       track.ExternalIds.Isrc,
+			Count:      len(group),
+		})
+	}
+
+	return duplicates
+}
+
+func duplicateKey(track Track) string {
+	switch {
+	case track.IsLocal || track.Id == "":
+		return "local:" + track.Name + " - " + artistNames(track.Artists, ", ")
+	case track.ExternalIds.Isrc != "":
+		return "isrc:" + track.ExternalIds.Isrc
+	default:
+		return "id:" + track.Id
+	}
+}
+
+// Keys the combined export can de-duplicate tracks by, see -dedup-by.
+const (
+	dedupById   = "id"
+	dedupByIsrc = "isrc"
+)
+
+// TrackWithSources is a track in the combined export, along with the
+// playlists it appears in, whether it is a saved track and when it was first
+// added. When tracks are matched by ISRC, Ids lists every track id that has
+// it.
+type TrackWithSources struct {
+	Track     Track    `json:"track"`
+	Ids       []string `json:"ids,omitempty"`
+	AddedAt   string   `json:"added_at,omitempty"`
+	Playlists []string `json:"playlists"`
+	Saved     bool     `json:"saved"`
+}
+
+// addToCombined adds items to the combined export. Tracks are keyed by their
+// id, falling back to the ISRC, and to name and artists for local tracks.
+// With byIsrc, the ISRC comes first, so re-releases of a recording are one
+// track. An empty playlist name marks saved tracks.
+func addToCombined(all map[string]*TrackWithSources, playlist string, items []Item, byIsrc bool) {
+	for _, item := range items {
+		key := combinedKey(item.Track)
+		if byIsrc && item.Track.ExternalIds.Isrc != "" {
+			key = "isrc:" + item.Track.ExternalIds.Isrc
+		}
+		entry, ok := all[key]
+		if !ok {
+			entry = &TrackWithSources{Track: item.Track, Playlists: make([]string, 0)}
+			all[key] = entry
+		}
+
+		if byIsrc && item.Track.Id != "" && !containsString(entry.Ids, item.Track.Id) {
+			entry.Ids = append(entry.Ids, item.Track.Id)
+		}
+		// The timestamps are all RFC 3339 in UTC, so they sort as strings.
+		if item.AddedAt != "" && (entry.AddedAt == "" || item.AddedAt < entry.AddedAt) {
+			entry.AddedAt = item.AddedAt
+		}
+
+		switch {
+		case playlist == "":
+			entry.Saved = true
+		case len(entry.Playlists) == 0 || entry.Playlists[len(entry.Playlists)-1] != playlist:
+			entry.Playlists = append(entry.Playlists, playlist)
+		}
+	}
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func combinedKey(track Track) string {
+	switch {
+	case track.Id != "":
+		return track.Id
+	case track.ExternalIds.Isrc != "":
+		return "isrc:" + track.ExternalIds.Isrc
+	default:
+		return "local:" + track.Name + " - " + artistNames(track.Artists, ", ")
+	}
+}
+
+// IsrcEntry is a track in the ISRC index, which maps ISRCs to tracks for
+// moving a library to another service.
+type IsrcEntry struct {
+	Track     string   `json:"track"`
+	Artists   string   `json:"artists"`
+	Playlists []string `json:"playlists"`
+	Saved     bool     `json:"saved"`
+}
+
+// addToIsrcIndex adds items to the ISRC index and returns how many had no
+// ISRC. An empty playlist name marks saved tracks.
+func addToIsrcIndex(index map[string]*IsrcEntry, playlist string, items []Item) int {
+	missing := 0
+	for _, item := range items {
+		isrc := strings.ToUpper(strings.TrimSpace(item.Track.ExternalIds.Isrc))
+		if isrc == "" {
+			missing++
+			continue
+		}
+
+		entry, ok := index[isrc]
+		if !ok {
+			entry = &IsrcEntry{
+				Track:     item.Track.Name,
+				Artists:   artistNames(item.Track.Artists, ", "),
+				Playlists: make([]string, 0),
+			}
+			index[isrc] = entry
+		}
+
+		switch {
+		case playlist == "":
+			entry.Saved = true
+		case len(entry.Playlists) == 0 || entry.Playlists[len(entry.Playlists)-1] != playlist:
+			entry.Playlists = append(entry.Playlists, playlist)
+		}
+	}
+
+	return missing
+}
+
+// PlaylistSummary is an at-a-glance profile of a playlist, written to
+// <name>.summary.json with -playlist-summaries.
+type PlaylistSummary struct {
+	Playlist          string  `json:"playlist"`
+	PlaylistId        string  `json:"playlist_id"`
+	Tracks            int     `json:"tracks"`
+	DurationMs        int64   `json:"duration_ms"`
+	Explicit          int     `json:"explicit"`
+	AveragePopularity float64 `json:"average_popularity"`
+	OldestAddedAt     string  `json:"oldest_added_at,omitempty"`
+	NewestAddedAt     string  `json:"newest_added_at,omitempty"`
+}
+
+// summarizePlaylist sums up the tracks of playlist. Local tracks have no
+// popularity, so they are left out of the average.
+func summarizePlaylist(playlist Playlist, items []Item) PlaylistSummary {
+	summary := PlaylistSummary{Playlist: playlist.Name, PlaylistId: playlist.Id, Tracks: len(items)}
+
+	var oldest, newest time.Time
+	popularity, rated := 0, 0
+	for _, item := range items {
+		summary.DurationMs += int64(item.Track.DurationMs)
+		if item.Track.Explicit {
+			summary.Explicit++
+		}
+		if !item.Track.IsLocal {
+			popularity += item.Track.Popularity
+			rated++
+		}
+
+		addedAt, err := time.Parse(time.RFC3339, item.AddedAt)
+		if err != nil {
+			continue
+		}
+		if oldest.IsZero() || addedAt.Before(oldest) {
+			oldest, summary.OldestAddedAt = addedAt, item.AddedAt
+		}
+		if newest.IsZero() || addedAt.After(newest) {
+			newest, summary.NewestAddedAt = addedAt, item.AddedAt
+		}
+	}
+	if rated > 0 {
+		summary.AveragePopularity = math.Round(float64(popularity)/float64(rated)*10) / 10
+	}
+
+	return summary
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func isrcItem(id string, isrc string, addedAt string) Item {
+	return Item{AddedAt: addedAt, Track: Track{Id: id, Name: "Song " + id, ExternalIds: ExternalId{Isrc: isrc}}}
+}
+
+func TestAddToCombinedByIsrc(t *testing.T) {
+	// The original release and a remaster share an ISRC, and the remaster
+	// was added first.
+	playlist := []Item{
+		isrcItem("original", "USRC17607839", "2024-03-01T10:00:00Z"),
+		isrcItem("remaster", "USRC17607839", "2023-05-01T10:00:00Z"),
+		isrcItem("other", "", "2024-01-01T10:00:00Z"),
+	}
+	saved := []Item{isrcItem("original", "USRC17607839", "2023-06-01T10:00:00Z")}
+
+	all := make(map[string]*TrackWithSources)
+	addToCombined(all, "Roadtrip", playlist, true)
+	addToCombined(all, "", saved, true)
+
+	if len(all) != 2 {
+		t.Fatalf("got %d combined tracks, want 2", len(all))
+	}
+
+	entry := all["isrc:USRC17607839"]
+	if entry == nil {
+		t.Fatal("no combined track for the shared ISRC")
+	}
+	if entry.AddedAt != "2023-05-01T10:00:00Z" {
+		t.Errorf("added_at = %s, want the earliest 2023-05-01T10:00:00Z", entry.AddedAt)
+	}
+	if want := []string{"original", "remaster"}; !reflect.DeepEqual(entry.Ids, want) {
+		t.Errorf("ids = %v, want %v", entry.Ids, want)
+	}
+	if want := []string{"Roadtrip"}; !reflect.DeepEqual(entry.Playlists, want) || !entry.Saved {
+		t.Errorf("playlists = %v, saved = %v, want %v and saved", entry.Playlists, entry.Saved, want)
+	}
+
+	// Tracks without an ISRC fall back to their id.
+	if other := all["other"]; other == nil || other.Ids[0] != "other" {
+		t.Errorf("track without ISRC = %+v, want it keyed by id", other)
+	}
+}
+
+func TestAddToCombinedById(t *testing.T) {
+	all := make(map[string]*TrackWithSources)
+	addToCombined(all, "Roadtrip", []Item{
+		isrcItem("original", "USRC17607839", "2024-03-01T10:00:00Z"),
+		isrcItem("remaster", "USRC17607839", "2023-05-01T10:00:00Z"),
+	}, false)
+
+	if len(all) != 2 {
+		t.Fatalf("got %d combined tracks, want one per id", len(all))
+	}
+	if ids := all["original"].Ids; ids != nil {
+		t.Errorf("ids = %v, want none when keyed by id", ids)
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// restoreScopes are needed on top of the read scopes to create playlists.
+var restoreScopes = []string{"playlist-modify-private", "playlist-modify-public"}
+
+// tracksPerRequest is the most tracks Spotify accepts in one add request.
+const tracksPerRequest = 100
+
+// Restore modes decide what happens to a playlist that already exists in the
+// account, either restored by an earlier run or with the same name.
+const (
+	restoreCreate  = "create"  // leave it alone
+	restoreReplace = "replace" // replace its tracks with the backed up ones
+	restoreAppend  = "append"  // add the backed up tracks it doesn't have
+)
+
+// restoredMarker is added to the description of restored playlists, so a
+// later restore finds them even if they have been renamed.
+func restoredMarker(playlistId string) string {
+	return fmt.Sprintf("[restored-from:%s]", playlistId)
+}
+
+// restoreBackup recreates every playlist listed in the manifest of dir for
+// the given user. Playlists that already exist are handled according to mode,
+// so a restore can be run again without creating duplicates. Every playlist
+// that was written to is fetched back afterwards and compared with the
+// backup.
+func restoreBackup(ctx context.Context, client *SpotifyClient, dir string, userId string, mode string) error {
+	manifest, err := readManifest(dir)
+	if err != nil {
+		return errors.Wrap(err, "failed to read manifest")
+	}
+
+	existing, err := client.fetchPlaylists(ctx, "")
+	if err != nil {
+		return err
+	}
+
+	verified, missingTracks := 0, 0
+	verify := func(restored Playlist, uris []string) {
+		missing, err := verifyRestored(ctx, client, restored, uris)
+		if err != nil {
+			slog.Error("Error verifying restored playlist", "playlist", restored.Name, "error", err)
+			return
+		}
+		verified++
+		missingTracks += missing
+	}
+
+	for _, entry := range manifest.Playlists {
+		playlist, items, err := loadPlaylistBackup(dir, entry)
+		if err != nil {
+			slog.Error("Error loading playlist backup", "playlist", entry.Name, "error", err)
+			continue
+		}
+		uris := restorableURIs(playlist, items)
+
+		match, ok := findRestored(existing, playlist, userId)
+		if !ok {
+			created, err := client.createPlaylist(ctx, userId, playlist)
+			if err != nil {
+				return errors.Wrapf(err, "failed to create playlist %s", playlist.Name)
+			}
+			if err := client.addTracks(ctx, created.Id, uris); err != nil {
+				return errors.Wrapf(err, "failed to add tracks to playlist %s", playlist.Name)
+			}
+			slog.Info("Restored playlist", "playlist", playlist.Name, "tracks", len(uris))
+			verify(*created, uris)
+			continue
+		}
+
+		switch mode {
+		case restoreReplace:
+			if err := client.replaceTracks(ctx, match.Id, uris); err != nil {
+				return errors.Wrapf(err, "failed to replace tracks in playlist %s", playlist.Name)
+			}
+			slog.Info("Replaced tracks in existing playlist", "playlist", playlist.Name, "tracks", len(uris))
+			verify(match, uris)
+		case restoreAppend:
+			current := client.fetchPlaylistTracks(ctx, match)
+			if current.Err != nil {
+				return current.Err
+			}
+			missing := missingURIs(uris, current.Items)
+			if err := client.addTracks(ctx, match.Id, missing); err != nil {
+				return errors.Wrapf(err, "failed to add tracks to playlist %s", playlist.Name)
+			}
+			slog.Info("Added missing tracks to existing playlist", "playlist", playlist.Name, "tracks", len(missing))
+			verify(match, uris)
+		default:
+			slog.Info("Playlist already exists, skipping", "playlist", playlist.Name)
+		}
+	}
+
+	slog.Info("Verified restored playlists", "playlists", verified, "missing_tracks", missingTracks)
+	return nil
+}
+
+// verifyRestored fetches the tracks of a restored playlist back and warns
+// about the backed up uris it doesn't have, such as tracks that couldn't be
+// added because they aren't available in the account's market. It returns
+// the number of missing tracks.
+func verifyRestored(ctx context.Context, client *SpotifyClient, playlist Playlist, uris []string) (int, error) {
+	current := client.fetchPlaylistTracks(ctx, playlist)
+	if current.Err != nil {
+		return 0, current.Err
+	}
+
+	missing := missingURIs(uris, current.Items)
+	if len(missing) > 0 {
+		slog.Warn("Restored playlist is missing tracks from the backup", "playlist", playlist.Name, "missing", len(missing), "tracks", strings.Join(missing, " "))
+	}
+
+	return len(missing), nil
+}
+
+// findRestored finds the user's playlist that playlist was restored to
+// before, by the marker in its description, or else one with the same name.
+func findRestored(existing []Playlist, playlist Playlist, userId string) (Playlist, bool) {
+	var byName *Playlist
+	for i, p := range existing {
+		if p.Owner.Id != userId {
+			continue
+		}
+		if strings.Contains(p.Description, restoredMarker(playlist.Id)) {
+			return p, true
+		}
+		if byName == nil && p.Name == playlist.Name {
+			byName = &existing[i]
+		}
+	}
+	if byName != nil {
+		return *byName, true
+	}
+
+	return Playlist{}, false
+}
+
+// missingURIs returns the uris that aren't already among items, keeping
+// their order. Items are compared by their URI before relinking.
+func missingURIs(uris []string, items []Item) []string {
+	have := make(map[string]bool, len(items))
+	for _, item := range items {
+		have[item.Track.originalUri()] = true
+	}
+
+	missing := make([]string, 0)
+	for _, uri := range uris {
+		if !have[uri] {
+			missing = append(missing, uri)
+		}
+	}
+
+	return missing
+}
+
+// loadPlaylistBackup reads the metadata and tracks of one manifest entry.
+// Backups without a metadata file fall back to the name, id and snapshot id
+// in the manifest.
+func loadPlaylistBackup(dir string, entry ManifestEntry) (Playlist, []Item, error) {
+	playlist := Playlist{Name: entry.Name, Id: entry.Id, SnapshotId: entry.SnapshotId}
+	var items []Item
+	var tracksFile string
+
+	for _, file := range entry.Files {
+		switch {
+		case strings.HasSuffix(file, ".meta.json"):
+			if err := readJSON(filepath.Join(dir, file), &playlist); err != nil {
+				return playlist, nil, err
+			}
+		case strings.HasSuffix(file, ".episodes.json"), strings.HasSuffix(file, ".summary.json"):
+			// Episodes can't be added back and aren't compared, and
+			// summaries are only for reading.
+		case strings.HasSuffix(file, ".json"):
+			tracksFile = file
+		}
+	}
+
+	if tracksFile == "" {
+		return playlist, nil, errors.New("no JSON track file in backup")
+	}
+	if err := readJSON(filepath.Join(dir, tracksFile), &items); err != nil {
+		return playlist, nil, err
+	}
+
+	return playlist, items, nil
+}
+
+// restorableURIs returns the URIs of the tracks that can be added back, in
+// their original playlist order. Relinked tracks are restored as the version
+// that was in the playlist, so they are relinked again for the market they
+// are played in. Local tracks only exist on the original device, so they are
+// skipped.
+func restorableURIs(playlist Playlist, items []Item) []string {
+	items = append([]Item(nil), items...)
+	sort.SliceStable(items, func(i, j int) bool { return items[i].Position < items[j].Position })
+
+	uris := make([]string, 0, len(items))
+	for _, item := range items {
+		if item.Track.IsLocal || item.Track.Uri == "" {
+			slog.Warn("Skipping track that can't be restored", "track", item.Track.Name, "playlist", playlist.Name)
+			continue
+		}
+		uris = append(uris, item.Track.originalUri())
+	}
+
+	return uris
+}
+
+func (c *SpotifyClient) createPlaylist(ctx context.Context, userId string, playlist Playlist) (*Playlist, error) {
+	description := strings.TrimSpace(playlist.Description + " " + restoredMarker(playlist.Id))
+	payload := map[string]interface{}{
+		"name":          playlist.Name,
+		"description":   description,
+		"public":        playlist.Public,
+		"collaborative": playlist.Collaborative,
+	}
+
+	var created Playlist
+	url := fmt.Sprintf("%s/v1/users/%s/playlists", c.baseURL, url.PathEscape(userId))
+	if err := c.postJSON(ctx, url, payload, &created); err != nil {
+		return nil, err
+	}
+
+	return &created, nil
+}
+
+// addTracks adds uris to a playlist in batches of tracksPerRequest.
+func (c *SpotifyClient) addTracks(ctx context.Context, playlistId string, uris []string) error {
+	url := fmt.Sprintf("%s/v1/playlists/%s/tracks", c.baseURL, playlistId)
+	for start := 0; start < len(uris); start += tracksPerRequest {
+		end := start + tracksPerRequest
+		if end > len(uris) {
+			end = len(uris)
+		}
+
+		payload := map[string][]string{"uris": uris[start:end]}
+		if err := c.postJSON(ctx, url, payload, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// replaceTracks replaces the tracks of a playlist with uris. Spotify replaces
+// at most tracksPerRequest tracks at a time, so the rest are added after.
+func (c *SpotifyClient) replaceTracks(ctx context.Context, playlistId string, uris []string) error {
+	first := uris
+	if len(first) > tracksPerRequest {
+		first = first[:tracksPerRequest]
+	}
+
+	url := fmt.Sprintf("%s/v1/playlists/%s/tracks", c.baseURL, playlistId)
+	if err := c.putJSON(ctx, url, map[string][]string{"uris": first}, nil); err != nil {
+		return err
+	}
+
+	return c.addTracks(ctx, playlistId, uris[len(first):])
+}
+
+// readJSON decodes filename in storage into v as it is read.
+func readJSON(filename string, v interface{}) error {
+	file, err := storage.Open(filename)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read %s", filename)
+	}
+	defer file.Close()
+
+	return errors.Wrapf(json.NewDecoder(file).Decode(v), "failed to parse %s", filename)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestSnapshotIdRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	playlist := Playlist{Name: "Roadtrip", Id: "p1", SnapshotId: "MTAsZDVmZjMy", Description: "For the car"}
+	items := []Item{{AddedAt: "2024-01-15T10:00:00Z", Track: Track{Id: "t1", Uri: "spotify:track:t1"}}}
+
+	tracksFile, err := saveJSONToFile(dir, "Roadtrip", items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metaFile, err := savePlaylistMetadata(dir, "Roadtrip", playlist)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := newManifest(time.Now(), "user")
+	manifest.addPlaylist(playlist, items, false, []string{tracksFile, metaFile})
+
+	loaded, loadedItems, err := loadPlaylistBackup(dir, manifest.Playlists[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.SnapshotId != playlist.SnapshotId || loaded.Description != playlist.Description {
+		t.Errorf("loaded playlist %+v, want snapshot id %s and description %q", loaded, playlist.SnapshotId, playlist.Description)
+	}
+	if len(loadedItems) != 1 || loadedItems[0].Track.Id != "t1" {
+		t.Errorf("loaded tracks %+v, want t1", loadedItems)
+	}
+
+	// Backups from before the metadata file was written only have the
+	// snapshot id in the manifest.
+	entry := manifest.Playlists[0]
+	entry.Files = []string{filepath.Base(tracksFile)}
+	loaded, _, err = loadPlaylistBackup(dir, entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.SnapshotId != playlist.SnapshotId || loaded.Id != playlist.Id || loaded.Name != playlist.Name {
+		t.Errorf("loaded playlist %+v from the manifest, want snapshot id %s", loaded, playlist.SnapshotId)
+	}
+}
+
+// relinkedPage has a track that Spotify relinked to another release for the
+// market, next to one that wasn't relinked.
+const relinkedPage = `{
+	"items": [
+		{"added_at": "2024-01-15T10:00:00Z", "track": {
+			"id": "playable", "name": "Relinked", "type": "track", "uri": "spotify:track:playable", "is_playable": true,
+			"linked_from": {"id": "original", "type": "track", "uri": "spotify:track:original"}
+		}},
+		{"added_at": "2024-01-16T10:00:00Z", "track": {"id": "plain", "name": "Plain", "type": "track", "uri": "spotify:track:plain"}}
+	],
+	"next": null,
+	"total": 2
+}`
+
+func TestRestorableURIsLinkedFrom(t *testing.T) {
+	m := newMockSpotify(t, map[string]string{
+		"/v1/playlists/p1/tracks?offset=0&limit=100&market=SE": relinkedPage,
+	})
+	client := m.client()
+	client.market = "SE"
+
+	playlist := Playlist{Id: "p1", Name: "Playlist"}
+	result := client.fetchPlaylistTracks(context.Background(), playlist)
+	if result.Err != nil {
+		t.Fatal(result.Err)
+	}
+	if got := result.Items[0].Track.Uri; got != "spotify:track:playable" {
+		t.Errorf("relinked track uri = %s, want the playable spotify:track:playable", got)
+	}
+
+	uris := restorableURIs(playlist, result.Items)
+	if want := []string{"spotify:track:original", "spotify:track:plain"}; !reflect.DeepEqual(uris, want) {
+		t.Errorf("restorable uris = %v, want %v", uris, want)
+	}
+
+	// Appending to a playlist holding the same relinked tracks adds nothing.
+	if missing := missingURIs(uris, result.Items); len(missing) != 0 {
+		t.Errorf("missing uris = %v, want none", missing)
+	}
+}
+
+func TestRestoreVerifiesPlaylists(t *testing.T) {
+	dir := t.TempDir()
+	playlist := Playlist{Name: "Roadtrip", Id: "p1"}
+	items := []Item{
+		{AddedAt: "2024-01-15T10:00:00Z", Track: Track{Id: "t1", Uri: "spotify:track:t1"}},
+		{AddedAt: "2024-01-16T10:00:00Z", Track: Track{Id: "t2", Uri: "spotify:track:t2"}},
+	}
+	tracksFile, err := saveJSONToFile(dir, "Roadtrip", items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := newManifest(time.Now(), "user")
+	manifest.addPlaylist(playlist, items, false, []string{tracksFile})
+	if err := writeManifest(dir, manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	// t2 isn't available in the account's market, so adding it does nothing.
+	m := newMockSpotify(t, map[string]string{
+		"/v1/me/playlists?offset=0&limit=50":          page("", 0),
+		"/v1/users/user/playlists":                    `{"id": "new", "name": "Roadtrip"}`,
+		"/v1/playlists/new/tracks":                    `{"snapshot_id": "snap"}`,
+		"/v1/playlists/new/tracks?offset=0&limit=100": page("", 1, trackItemJSON("t1", "One")),
+	})
+	client := m.client()
+
+	if err := restoreBackup(context.Background(), client, dir, "user", restoreCreate); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.requests[len(m.requests)-1]; got != "/v1/playlists/new/tracks?offset=0&limit=100" {
+		t.Errorf("last request = %s, want the restored playlist fetched back", got)
+	}
+
+	missing, err := verifyRestored(context.Background(), client, Playlist{Id: "new", Name: "Roadtrip"}, restorableURIs(playlist, items))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if missing != 1 {
+		t.Errorf("verifyRestored found %d missing tracks, want 1", missing)
+	}
+}
+
+func TestAddTracksNotRetriedAfterServerError(t *testing.T) {
+	var mu sync.Mutex
+	statuses := []int{http.StatusTooManyRequests, http.StatusOK, http.StatusBadGateway}
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		status := http.StatusOK
+		if requests < len(statuses) {
+			status = statuses[requests]
+		}
+		requests++
+
+		// Retry-After: 0 keeps the test from waiting.
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(status)
+		fmt.Fprint(w, `{"snapshot_id": "snap"}`)
+	}))
+	t.Cleanup(srv.Close)
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests
+	}
+	client := NewSpotifyClient(srv.Client(), rate.NewLimiter(rate.Inf, 1))
+	client.baseURL = srv.URL
+
+	// A rate-limited batch wasn't added, so it's sent again.
+	if err := client.addTracks(context.Background(), "p1", []string{"spotify:track:t1"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(); n != 2 {
+		t.Errorf("addTracks made %d requests after a 429, want 2", n)
+	}
+
+	// A batch that got a server error may still have been added.
+	if err := client.addTracks(context.Background(), "p1", []string{"spotify:track:t1"}); err == nil {
+		t.Error("addTracks succeeded after a 502, want the error")
+	}
+	if n := count(); n != 3 {
+		t.Errorf("addTracks made %d requests after a 502, want it not to be retried", n-2)
+	}
+}
+
+func TestCreatePlaylistEscapesUserId(t *testing.T) {
+	m := newMockSpotify(t, map[string]string{
+		"/v1/users/j%C3%B6rg%2Fsmith/playlists": `{"id": "new", "name": "Roadtrip"}`,
+	})
+
+	created, err := m.client().createPlaylist(context.Background(), "jörg/smith", Playlist{Id: "p1", Name: "Roadtrip"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.Id != "new" {
+		t.Errorf("created playlist %+v, want new", created)
+	}
+}
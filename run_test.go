@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// memStorage keeps the files of a run in memory, keyed by path.
+type memStorage struct {
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{files: make(map[string][]byte)}
+}
+
+func (s *memStorage) Write(path string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[filepath.Clean(path)] = append([]byte(nil), data...)
+	return nil
+}
+
+func (s *memStorage) Create(path string, write func(w io.Writer) error) error {
+	var b bytes.Buffer
+	if err := write(&b); err != nil {
+		return err
+	}
+
+	return s.Write(path, b.Bytes())
+}
+
+func (s *memStorage) Open(path string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.files[filepath.Clean(path)]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+	}
+
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *memStorage) Exists(path string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.files[filepath.Clean(path)]
+	return ok, nil
+}
+
+func (s *memStorage) Mkdir(path string) error {
+	return nil
+}
+
+// below returns the paths of the files below dir, sorted.
+func (s *memStorage) below(dir string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prefix := filepath.Clean(dir) + string(filepath.Separator)
+	var paths []string
+	for path := range s.files {
+		if strings.HasPrefix(path, prefix) {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	return paths
+}
+
+func (s *memStorage) Walk(dir string, fn func(path string, rel string, size int64) error) error {
+	for _, path := range s.below(dir) {
+		s.mu.Lock()
+		size := len(s.files[path])
+		s.mu.Unlock()
+
+		if err := fn(path, strings.TrimPrefix(path, filepath.Clean(dir)+string(filepath.Separator)), int64(size)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *memStorage) Remove(path string) error {
+	paths := append(s.below(path), filepath.Clean(path))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range paths {
+		delete(s.files, p)
+	}
+
+	return nil
+}
+
+func (s *memStorage) Link(target string, link string) error {
+	return copyFiles(s, target, link)
+}
+
+// read returns the file at path, failing the test if there is none.
+func (s *memStorage) read(t *testing.T, path string) []byte {
+	t.Helper()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.files[filepath.Clean(path)]
+	if !ok {
+		t.Fatalf("%s wasn't written", path)
+	}
+
+	return data
+}
+
+// setFlags sets command line flags for the rest of a test.
+func setFlags(t *testing.T, values map[string]string) {
+	for name, value := range values {
+		f := flag.Lookup(name)
+		previous := f.Value.String()
+		if err := f.Value.Set(value); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { f.Value.Set(previous) })
+	}
+}
+
+// runBackup runs a whole backup against the mock server, with a valid cached
+// token, into memory. It returns the run's storage and its backup folder.
+func runBackup(t *testing.T, m *mockSpotify) (*memStorage, string, error) {
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "token.json")
+	if err := os.WriteFile(tokenFile, []byte(`{"access_token": "test", "token_type": "Bearer", "expiry": "2099-01-01T00:00:00Z"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("SPOTIFY_CLIENT_ID", "test")
+	t.Setenv("SPOTIFY_CLIENT_SECRET", "")
+	t.Setenv("BACKUP_FORMAT", "")
+	t.Setenv("TOKEN_ENCRYPTION_KEY", "")
+	setFlags(t, map[string]string{
+		"output":     filepath.Join(dir, "backups"),
+		"token-path": tokenFile,
+		"rps":        "1000",
+		"quiet":      "true",
+	})
+
+	previousStorage, previousAddress, previousRun := storage, baseAPIAddress, lastRun.Load()
+	t.Cleanup(func() {
+		storage, baseAPIAddress = previousStorage, previousAddress
+		lastRun.Store(previousRun)
+	})
+	mem := newMemStorage()
+	storage = mem
+	baseAPIAddress = m.URL
+
+	err := run(context.Background())
+	return mem, filepath.Join(dir, "backups"), err
+}
+
+// backupFixture is a library of three playlists over two pages, one of them
+// with two pages of tracks and a Unicode name, and one with a track removed
+// from the catalog. The last two playlists have names that only differ in
+// characters that aren't allowed in file names.
+var backupFixture = map[string]string{
+	"/v1/me": `{"id": "listener", "display_name": "Listener", "type": "user"}`,
+	"/v1/me/playlists?offset=0&limit=50": page("{{base}}/v1/me/playlists?offset=2&limit=2", 3,
+		playlistJSON("p3", "AC-DC: Hits"), playlistJSON("p1", "日本語 🎌")),
+	"/v1/me/playlists?offset=2&limit=2": page("", 3, playlistJSON("p2", "AC/DC: Hits")),
+
+	"/v1/playlists/p1/tracks?offset=0&limit=100": page("{{base}}/v1/playlists/p1/tracks?offset=2&limit=2", 3,
+		trackItemJSON("t1", "夜に駆ける"), trackItemJSON("t2", "Lemon")),
+	"/v1/playlists/p1/tracks?offset=2&limit=2": page("", 3, trackItemJSON("t3", "紅蓮華")),
+	"/v1/playlists/p2/tracks?offset=0&limit=100": page("", 2,
+		`{"added_at": "2024-01-16T10:00:00Z", "track": null}`, trackItemJSON("t4", "Thunderstruck")),
+	"/v1/playlists/p3/tracks?offset=0&limit=100": page("", 1, trackItemJSON("t5", "Back in Black")),
+
+	"/v1/me/tracks?offset=0&limit=50":   page("", 1, trackItemJSON("t1", "夜に駆ける")),
+	"/v1/me/shows?offset=0&limit=50":    page("", 0),
+	"/v1/me/episodes?offset=0&limit=50": page("", 0),
+}
+
+func TestRunBackup(t *testing.T) {
+	m := newMockSpotify(t, backupFixture)
+	mem, root, err := runBackup(t, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	latest := filepath.Join(root, latestName)
+	var manifest Manifest
+	if err := json.Unmarshal(mem.read(t, filepath.Join(latest, "manifest.json")), &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if manifest.UserId != "listener" || manifest.TotalPlaylists != 3 || manifest.TotalTracks != 5 || manifest.SavedTracks != 1 {
+		t.Errorf("manifest = user %s, %d playlists, %d tracks, %d saved tracks, want listener, 3, 5 and 1",
+			manifest.UserId, manifest.TotalPlaylists, manifest.TotalTracks, manifest.SavedTracks)
+	}
+
+	// Playlists are sorted by id, so the collision suffix always goes to
+	// the same one.
+	want := []struct {
+		id     string
+		tracks int
+		files  string
+	}{
+		{"p1", 3, "日本語 🎌.json 日本語 🎌.meta.json"},
+		{"p2", 1, "AC-DC- Hits.json AC-DC- Hits.meta.json"},
+		{"p3", 1, "AC-DC- Hits-p3.json AC-DC- Hits-p3.meta.json"},
+	}
+	if len(manifest.Playlists) != len(want) {
+		t.Fatalf("manifest lists %d playlists, want %d", len(manifest.Playlists), len(want))
+	}
+	for i, w := range want {
+		entry := manifest.Playlists[i]
+		if entry.Id != w.id || entry.TrackCount != w.tracks || entry.SnapshotId != "snap-"+w.id || strings.Join(entry.Files, " ") != w.files {
+			t.Errorf("playlist %d = %s with %d tracks, snapshot %s in %v, want %s with %d in %s",
+				i, entry.Id, entry.TrackCount, entry.SnapshotId, entry.Files, w.id, w.tracks, w.files)
+		}
+	}
+
+	var tracks []Item
+	if err := json.Unmarshal(mem.read(t, filepath.Join(latest, "AC-DC- Hits.json")), &tracks); err != nil {
+		t.Fatal(err)
+	}
+	if len(tracks) != 1 || tracks[0].Track.Id != "t4" || tracks[0].Position != 1 {
+		t.Errorf("tracks = %+v, want only t4 at position 1 after the removed track", tracks)
+	}
+
+	if err := json.Unmarshal(mem.read(t, filepath.Join(latest, "日本語 🎌.json")), &tracks); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, item := range tracks {
+		names = append(names, item.Track.Name)
+	}
+	if got := strings.Join(names, ", "); got != "夜に駆ける, Lemon, 紅蓮華" {
+		t.Errorf("tracks = %s, want both pages in order", got)
+	}
+
+	for _, name := range []string{"saved_tracks.json", "saved_shows.json", "saved_episodes.json", "profile.json", "stats.json", checksumFile} {
+		mem.read(t, filepath.Join(latest, name))
+	}
+	if problems, err := verifyChecksums(latest); err != nil || problems != 0 {
+		t.Errorf("verifying the backup found %d problems, %v", problems, err)
+	}
+	if run := lastRun.Load(); run == nil || run.report.Tracks != 5 {
+		t.Errorf("last run = %+v, want the stats of this backup for -metrics-port", run)
+	}
+}
+
+func TestRunBackupDeletedPlaylist(t *testing.T) {
+	// p3 is listed, but deleted before its tracks are fetched.
+	fixture := make(map[string]string)
+	for path, body := range backupFixture {
+		fixture[path] = body
+	}
+	delete(fixture, "/v1/playlists/p3/tracks?offset=0&limit=100")
+
+	m := newMockSpotify(t, fixture)
+	mem, root, err := runBackup(t, m)
+	if err != nil {
+		t.Fatalf("run returned %v, want a deleted playlist to be skipped", err)
+	}
+
+	latest := filepath.Join(root, latestName)
+	var manifest Manifest
+	if err := json.Unmarshal(mem.read(t, filepath.Join(latest, "manifest.json")), &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Gone) != 1 || manifest.Gone[0].Id != "p3" || len(manifest.Gone[0].Files) != 0 {
+		t.Errorf("manifest.Gone = %+v, want only p3 without files", manifest.Gone)
+	}
+	if manifest.TotalPlaylists != 2 || manifest.TotalTracks != 4 {
+		t.Errorf("manifest counts %d playlists and %d tracks, want 2 and 4", manifest.TotalPlaylists, manifest.TotalTracks)
+	}
+	for _, entry := range manifest.Playlists {
+		if entry.Id == "p3" {
+			t.Errorf("deleted playlist p3 is listed as backed up in %v", entry.Files)
+		}
+	}
+
+	for _, name := range []string{"AC-DC- Hits-p3.json", "AC-DC- Hits-p3.meta.json"} {
+		if exists, _ := mem.Exists(filepath.Join(latest, name)); exists {
+			t.Errorf("%s was written for the deleted playlist", name)
+		}
+	}
+	mem.read(t, filepath.Join(latest, "AC-DC- Hits.json"))
+}
+
+func TestRunBackupFilteredLeavesLatest(t *testing.T) {
+	for _, f := range []struct{ name, value string }{
+		{"playlists", "p1"},
+		{"playlists-regex", "^AC"},
+		{"only-public", "true"},
+		{"only-private", "true"},
+		{"skip-collaborative", "true"},
+	} {
+		t.Run(f.name, func(t *testing.T) {
+			setFlags(t, map[string]string{f.name: f.value})
+			m := newMockSpotify(t, backupFixture)
+			mem, root, err := runBackup(t, m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if exists, _ := mem.Exists(filepath.Join(root, latestName, "manifest.json")); exists {
+				t.Errorf("-%s %s updated %s, want a filtered backup to leave it alone", f.name, f.value, latestName)
+			}
+		})
+	}
+}
+
+func TestRunCompactWithIndent(t *testing.T) {
+	setFlags(t, map[string]string{"compact": "true"})
+	// flag.Set marks -indent as given on the command line, unlike setFlags.
+	previous := *indentFlag
+	if err := flag.Set("indent", "4"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { *indentFlag = previous })
+
+	if err := run(context.Background()); err == nil || !strings.Contains(err.Error(), "-compact") {
+		t.Errorf("run with -compact and -indent returned %v, want an error", err)
+	}
+}
+
+func TestRunByYearPlaylistsNeedsByYear(t *testing.T) {
+	setFlags(t, map[string]string{"by-year-playlists": "true"})
+	m := newMockSpotify(t, backupFixture)
+	if _, _, err := runBackup(t, m); err == nil || !strings.Contains(err.Error(), "-by-year") {
+		t.Errorf("run with -by-year-playlists alone returned %v, want an error", err)
+	}
+	if n := m.requestCount(); n != 0 {
+		t.Errorf("run made %d requests, want it to stop before the backup", n)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultBackupFolder = "backups"
+	latestName          = "latest"
+
+	// runDirLayout names run directories by their start time. It avoids
+	// colons so the names are valid on Windows too.
+	runDirLayout = "2006-01-02T15-04-05"
+)
+
+// checkWritable creates dir if needed and verifies that files can be written
+// to it.
+func checkWritable(dir string) error {
+	if err := storage.Mkdir(dir); err != nil {
+		return errors.Wrapf(err, "failed to create %s", dir)
+	}
+
+	test := filepath.Join(dir, fmt.Sprintf(".write-test-%d", os.Getpid()))
+	if err := storage.Write(test, nil); err != nil {
+		return errors.Wrapf(err, "%s is not writable", dir)
+	}
+
+	return storage.Remove(test)
+}
+
+// createRunDir creates the directory a single backup run is written to.
+func createRunDir(root string, started time.Time) (string, error) {
+	dir := filepath.Join(root, started.Format(runDirLayout))
+	if err := storage.Mkdir(dir); err != nil {
+		return "", errors.Wrapf(err, "failed to create %s", dir)
+	}
+
+	return dir, nil
+}
+
+// updateLatest points root/latest at runDir: a relative symlink on the local
+// file system, falling back to a copy of the run on systems without symlinks.
+func updateLatest(root string, runDir string) error {
+	latest := filepath.Join(root, latestName)
+	if err := storage.Remove(latest); err != nil {
+		return errors.Wrapf(err, "failed to remove %s", latest)
+	}
+
+	return storage.Link(runDir, latest)
+}
+
+// checkResumeDir makes sure dir is a run folder directly in root, since
+// latest is pointed at it, next to it, once the run is done. latest itself
+// links to a run and can't be resumed.
+func checkResumeDir(root string, dir string) error {
+	if _, ok := runTime(filepath.Base(filepath.Clean(dir))); !ok {
+		return errors.Errorf("invalid -resume %s: expected a run folder such as %s", dir, filepath.Join(root, time.Now().Format(runDirLayout)))
+	}
+
+	resolvedDir, err := resolvePath(dir)
+	if err != nil {
+		return errors.Wrapf(err, "failed to resolve %s", dir)
+	}
+	resolvedRoot, err := resolvePath(root)
+	if err != nil {
+		return errors.Wrapf(err, "failed to resolve %s", root)
+	}
+	if filepath.Dir(resolvedDir) != resolvedRoot {
+		return errors.Errorf("invalid -resume %s: it isn't a run folder in the backup folder %s", dir, root)
+	}
+
+	return nil
+}
+
+// resolvePath returns the absolute path of path with its symlinks resolved.
+func resolvePath(path string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Abs(resolved)
+}
+
+// archivePrefix and archiveSuffixes make up the names of run archives.
+const archivePrefix = "backup-"
+
+var archiveSuffixes = []string{".zip", ".tar.gz"}
+
+// runTime returns the start time of the run a run folder or archive in the
+// backup folder belongs to.
+func runTime(name string) (time.Time, bool) {
+	if strings.HasPrefix(name, archivePrefix) {
+		for _, suffix := range archiveSuffixes {
+			if strings.HasSuffix(name, suffix) {
+				name = strings.TrimSuffix(strings.TrimPrefix(name, archivePrefix), suffix)
+				break
+			}
+		}
+	}
+
+	t, err := time.ParseInLocation(runDirLayout, name, time.Local)
+	return t, err == nil
+}
+
+// pruneBackups deletes the run folders and archives in root beyond the keep
+// most recent runs, and those older than maxAge. Zero disables either limit.
+// The current run and the run latest points at are always kept.
+func pruneBackups(root string, current string, keep int, maxAge time.Duration) error {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read %s", root)
+	}
+
+	protected := map[string]bool{filepath.Base(current): true}
+	if target, err := os.Readlink(filepath.Join(root, latestName)); err == nil {
+		protected[filepath.Base(target)] = true
+	}
+
+	// A run folder and its archive count as one run.
+	runs := make(map[time.Time][]string)
+	var times []time.Time
+	for _, entry := range entries {
+		t, ok := runTime(entry.Name())
+		if !ok {
+			continue
+		}
+		if _, seen := runs[t]; !seen {
+			times = append(times, t)
+		}
+		runs[t] = append(runs[t], entry.Name())
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].After(times[j]) })
+
+	for i, t := range times {
+		if (keep == 0 || i < keep) && (maxAge == 0 || time.Since(t) <= maxAge) {
+			continue
+		}
+
+		name := t.Format(runDirLayout)
+		if protected[name] {
+			continue
+		}
+		for _, entry := range runs[t] {
+			if err := os.RemoveAll(filepath.Join(root, entry)); err != nil {
+				return errors.Wrapf(err, "failed to remove %s", entry)
+			}
+			slog.Info("Removed old backup", "name", entry)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckResumeDir(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "backups")
+	runDir := filepath.Join(root, "2024-01-15T14-30-05")
+	elsewhere := filepath.Join(t.TempDir(), "2024-01-15T14-30-05")
+	for _, dir := range []string{runDir, elsewhere} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	latest := filepath.Join(root, latestName)
+	if err := os.Symlink(filepath.Base(runDir), latest); err != nil {
+		t.Skipf("symlinks aren't supported: %v", err)
+	}
+
+	if err := checkResumeDir(root, runDir); err != nil {
+		t.Errorf("checkResumeDir(%s) = %v, want a run folder in the backup folder accepted", runDir, err)
+	}
+	for _, dir := range []string{latest, elsewhere, root, filepath.Join(root, "missing")} {
+		if err := checkResumeDir(root, dir); err == nil {
+			t.Errorf("checkResumeDir(%s) accepted it, want an error", dir)
+		}
+	}
+}
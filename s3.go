@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/pkg/errors"
+)
+
+// S3Storage writes to a bucket on S3 or an S3-compatible store such as MinIO.
+// Paths are used as object keys, so folders are key prefixes and need no
+// creating. Requests aren't cancelled with the run, so an interrupted run can
+// still save its manifest, like on the local file system.
+type S3Storage struct {
+	client *s3.Client
+	bucket string
+}
+
+// parseS3URL splits an s3://bucket/prefix output into bucket and prefix. It
+// returns false if output isn't an s3:// URL.
+func parseS3URL(output string) (string, string, bool, error) {
+	if !strings.HasPrefix(output, "s3://") {
+		return "", "", false, nil
+	}
+
+	u, err := url.Parse(output)
+	if err != nil || u.Host == "" {
+		return "", "", true, errors.Errorf("invalid output %q: expected s3://bucket/prefix", output)
+	}
+
+	return u.Host, strings.Trim(u.Path, "/"), true, nil
+}
+
+// newS3Storage creates a storage for bucket. Credentials, region and endpoint
+// come from the standard AWS environment variables, shared config files and
+// instance roles. A custom endpoint, as used by MinIO, is addressed with
+// path-style URLs.
+func newS3Storage(ctx context.Context, bucket string) (*S3Storage, error) {
+	// The SDK's own client is kept so AWS_CA_BUNDLE still works, but it goes
+	// through the same proxy as everything else.
+	client := awshttp.NewBuildableClient()
+	if transport, ok := httpClient.Transport.(*userAgentTransport); ok {
+		client = client.WithTransportOptions(func(t *http.Transport) {
+			t.Proxy = transport.base.Proxy
+		})
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithHTTPClient(client))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load AWS config")
+	}
+
+	s3Client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		o.UsePathStyle = o.BaseEndpoint != nil
+	})
+
+	return &S3Storage{client: s3Client, bucket: bucket}, nil
+}
+
+// key returns the object key of path.
+func (s *S3Storage) key(path string) string {
+	return strings.TrimPrefix(filepath.ToSlash(path), "/")
+}
+
+// prefix returns the key prefix of the objects below dir.
+func (s *S3Storage) prefix(dir string) string {
+	if key := strings.TrimSuffix(s.key(dir), "/"); key != "" {
+		return key + "/"
+	}
+
+	return ""
+}
+
+func (s *S3Storage) url(path string) string {
+	return "s3://" + s.bucket + "/" + s.key(path)
+}
+
+func (s *S3Storage) Write(path string, data []byte) error {
+	return s.put(path, bytes.NewReader(data))
+}
+
+// Create stages the file in a temporary file, so it's never held in memory
+// and nothing is uploaded if write fails.
+func (s *S3Storage) Create(path string, write func(w io.Writer) error) error {
+	tmp, err := os.CreateTemp("", "spotify-backup-*")
+	if err != nil {
+		return errors.Wrap(err, "failed to create temporary file")
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	w := bufio.NewWriter(tmp)
+	if err := write(w); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	return s.put(path, tmp)
+}
+
+func (s *S3Storage) put(path string, body io.Reader) error {
+	_, err := s.client.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(path)),
+		Body:   body,
+	})
+
+	return errors.Wrapf(err, "failed to upload %s", s.url(path))
+}
+
+func (s *S3Storage) Open(path string) (io.ReadCloser, error) {
+	out, err := s.client.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(path)),
+	})
+	if isS3NotFound(err) {
+		return nil, &os.PathError{Op: "open", Path: s.url(path), Err: os.ErrNotExist}
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to download %s", s.url(path))
+	}
+
+	return out.Body, nil
+}
+
+func (s *S3Storage) Exists(path string) (bool, error) {
+	_, err := s.client.HeadObject(context.Background(), &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(path)),
+	})
+	if isS3NotFound(err) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// Mkdir does nothing, since folders are only key prefixes.
+func (s *S3Storage) Mkdir(path string) error {
+	return nil
+}
+
+func (s *S3Storage) Walk(dir string, fn func(path string, rel string, size int64) error) error {
+	prefix := s.prefix(dir)
+	pages := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(context.Background())
+		if err != nil {
+			return errors.Wrapf(err, "failed to list %s", s.url(dir))
+		}
+
+		for _, object := range page.Contents {
+			key := aws.ToString(object.Key)
+			rel := filepath.FromSlash(strings.TrimPrefix(key, prefix))
+			if err := fn(filepath.FromSlash(key), rel, aws.ToInt64(object.Size)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Remove deletes the object path and the objects below it, up to a page of
+// them per request.
+func (s *S3Storage) Remove(path string) error {
+	objects := []types.ObjectIdentifier{{Key: aws.String(s.key(path))}}
+	flush := func() error {
+		_, err := s.client.DeleteObjects(context.Background(), &s3.DeleteObjectsInput{
+			Bucket: aws.String(s.bucket),
+			Delete: &types.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		})
+		objects = nil
+		return errors.Wrapf(err, "failed to delete %s", s.url(path))
+	}
+
+	err := s.Walk(path, func(key string, rel string, size int64) error {
+		objects = append(objects, types.ObjectIdentifier{Key: aws.String(s.key(key))})
+		if len(objects) == 1000 {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil || len(objects) == 0 {
+		return err
+	}
+
+	return flush()
+}
+
+// Link copies the objects of target below link within the bucket, since
+// object storage has no links.
+func (s *S3Storage) Link(target string, link string) error {
+	return s.Walk(target, func(path string, rel string, size int64) error {
+		dst := filepath.Join(link, rel)
+		_, err := s.client.CopyObject(context.Background(), &s3.CopyObjectInput{
+			Bucket:     aws.String(s.bucket),
+			Key:        aws.String(s.key(dst)),
+			CopySource: aws.String(s.bucket + "/" + (&url.URL{Path: s.key(path)}).EscapedPath()),
+		})
+
+		return errors.Wrapf(err, "failed to copy %s to %s", s.url(path), s.url(dst))
+	})
+}
+
+// isS3NotFound reports whether a request failed because the object doesn't
+// exist.
+func isS3NotFound(err error) bool {
+	var respErr *awshttp.ResponseError
+	return errors.As(err, &respErr) && respErr.HTTPStatusCode() == http.StatusNotFound
+}
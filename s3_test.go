@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeS3 implements the few S3 requests S3Storage makes, for a single bucket
+// addressed path-style like MinIO.
+type fakeS3 struct {
+	mu      sync.Mutex
+	bucket  string
+	objects map[string][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != f.bucket {
+		http.Error(w, "no such bucket", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && key == "" && r.URL.Query().Get("list-type") == "2":
+		prefix := r.URL.Query().Get("prefix")
+		var keys []string
+		for k := range f.objects {
+			if strings.HasPrefix(k, prefix) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		fmt.Fprint(w, `<ListBucketResult><IsTruncated>false</IsTruncated>`)
+		for _, k := range keys {
+			fmt.Fprintf(w, `<Contents><Key>%s</Key><Size>%d</Size></Contents>`, k, len(f.objects[k]))
+		}
+		fmt.Fprint(w, `</ListBucketResult>`)
+	case r.Method == http.MethodPost && r.URL.Query().Has("delete"):
+		var body struct {
+			Objects []struct{ Key string } `xml:"Object"`
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, object := range body.Objects {
+			delete(f.objects, object.Key)
+		}
+		fmt.Fprint(w, `<DeleteResult></DeleteResult>`)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		source, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data, ok := f.objects[strings.TrimPrefix(source, f.bucket+"/")]
+		if !ok {
+			http.Error(w, "no such key", http.StatusNotFound)
+			return
+		}
+		f.objects[key] = data
+		fmt.Fprint(w, `<CopyObjectResult></CopyObjectResult>`)
+	case r.Method == http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.objects[key] = data
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		data, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `<Error><Code>NoSuchKey</Code></Error>`)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		w.Write(data)
+	default:
+		http.Error(w, "not implemented", http.StatusNotImplemented)
+	}
+}
+
+func newFakeS3Storage(t *testing.T) (*S3Storage, *fakeS3) {
+	fake := &fakeS3{bucket: "backups", objects: make(map[string][]byte)}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	t.Setenv("AWS_ENDPOINT_URL", srv.URL)
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	t.Setenv("AWS_CA_BUNDLE", "")
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(t.TempDir(), "credentials"))
+
+	s, err := newS3Storage(context.Background(), fake.bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s, fake
+}
+
+func TestS3Storage(t *testing.T) {
+	s, fake := newFakeS3Storage(t)
+	run := filepath.Join("spotify", "2024-01-15T14-30-05")
+
+	if err := s.Write(filepath.Join(run, "manifest.json"), []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	err := s.Create(filepath.Join(run, "art", "al1.jpg"), func(w io.Writer) error {
+		_, err := io.WriteString(w, "cover")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Create(filepath.Join(run, "failed.json"), func(w io.Writer) error { return io.ErrShortWrite }); err != io.ErrShortWrite {
+		t.Errorf("Create returned %v, want the error of write", err)
+	}
+	if _, ok := fake.objects["spotify/2024-01-15T14-30-05/failed.json"]; ok {
+		t.Error("a failed Create was uploaded")
+	}
+
+	if exists, err := s.Exists(filepath.Join(run, "manifest.json")); err != nil || !exists {
+		t.Errorf("Exists(manifest.json) = %v, %v, want true", exists, err)
+	}
+	if exists, err := s.Exists(filepath.Join(run, "missing.json")); err != nil || exists {
+		t.Errorf("Exists(missing.json) = %v, %v, want false", exists, err)
+	}
+	if _, err := s.Open(filepath.Join(run, "missing.json")); !os.IsNotExist(err) {
+		t.Errorf("Open(missing.json) returned %v, want a not exist error", err)
+	}
+
+	var files []string
+	err = s.Walk(run, func(path string, rel string, size int64) error {
+		files = append(files, fmt.Sprintf("%s %d", filepath.ToSlash(rel), size))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(files, ", "), "art/al1.jpg 5, manifest.json 2"; got != want {
+		t.Errorf("Walk found %s, want %s", got, want)
+	}
+
+	latest := filepath.Join("spotify", latestName)
+	if err := s.Link(run, latest); err != nil {
+		t.Fatal(err)
+	}
+	in, err := s.Open(filepath.Join(latest, "art", "al1.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(in)
+	in.Close()
+	if string(data) != "cover" {
+		t.Errorf("linked file = %q, want %q", data, "cover")
+	}
+
+	if err := s.Remove(latest); err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for key := range fake.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if got, want := strings.Join(keys, ", "), "spotify/2024-01-15T14-30-05/art/al1.jpg, spotify/2024-01-15T14-30-05/manifest.json"; got != want {
+		t.Errorf("objects after Remove = %s, want %s", got, want)
+	}
+}
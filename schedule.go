@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math/rand"
+	"time"
+)
+
+// runEvery runs a backup every interval until ctx is cancelled, waiting an
+// extra random delay of up to a tenth of the interval so runs don't always hit
+// Spotify at the same time. A failed run is logged, and the next one is still
+// made.
+func runEvery(ctx context.Context, interval time.Duration) {
+	for {
+		started := time.Now()
+		stats.reset()
+		if err := runOnce(ctx); err != nil {
+			slog.Error("Backup failed", "error", err)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		next := started.Add(interval + time.Duration(rand.Int63n(int64(interval/10)+1)))
+		slog.Info("Waiting for the next backup", "at", next.Format(time.RFC3339))
+
+		select {
+		case <-time.After(time.Until(next)):
+		case <-ctx.Done():
+			slog.Info("Stopping", "reason", ctx.Err())
+			return
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+)
+
+// checkScopes returns the scopes in conf that token wasn't granted. Spotify
+// returns the granted scopes along with a token, but they aren't kept in the
+// token cache, so a cached token is refreshed to learn them. The refreshed
+// token is returned, and saved to the cache, in its place.
+func checkScopes(ctx context.Context, conf *oauth2.Config, token *oauth2.Token) (*oauth2.Token, []string, error) {
+	granted, _ := token.Extra("scope").(string)
+	if granted == "" {
+		if token.RefreshToken == "" {
+			return nil, nil, errors.New("the cached token has no refresh token to look up its scopes with")
+		}
+
+		refreshed, err := newTokenSource(ctx, conf, &oauth2.Token{RefreshToken: token.RefreshToken}).Token()
+		if err != nil {
+			return nil, nil, err
+		}
+		token = refreshed
+
+		granted, _ = token.Extra("scope").(string)
+		if granted == "" {
+			return nil, nil, errors.New("Spotify didn't return the scopes granted to the token")
+		}
+	}
+
+	return token, missingScopes(strings.Fields(granted), conf.Scopes), nil
+}
+
+// missingScopes lists the scopes in required that aren't in granted.
+func missingScopes(granted []string, required []string) []string {
+	have := make(map[string]bool, len(granted))
+	for _, scope := range granted {
+		have[scope] = true
+	}
+
+	var missing []string
+	for _, scope := range required {
+		if !have[scope] {
+			missing = append(missing, scope)
+		}
+	}
+
+	return missing
+}
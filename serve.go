@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//go:embed serve.html
+var servePage []byte
+
+// savedTracksId is the playlist id the browser lists the saved tracks under.
+const savedTracksId = "saved"
+
+// browser serves a read-only web UI for one backup run, loaded into memory
+// when it starts.
+type browser struct {
+	manifest  *Manifest
+	playlists []backupPlaylist
+}
+
+type browserPlaylist struct {
+	Id         string `json:"id"`
+	Name       string `json:"name"`
+	Owner      string `json:"owner"`
+	TrackCount int    `json:"track_count"`
+}
+
+type browserTrack struct {
+	Playlist   string `json:"playlist"`
+	PlaylistId string `json:"playlist_id"`
+	Name       string `json:"name"`
+	Artists    string `json:"artists"`
+	Album      string `json:"album"`
+	AddedAt    string `json:"added_at"`
+	DurationMs int    `json:"duration_ms"`
+	Url        string `json:"url"`
+}
+
+// loadBrowser reads the playlists and saved tracks of the backup in dir.
+func loadBrowser(dir string) (*browser, error) {
+	manifest, err := readManifest(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read manifest")
+	}
+	playlists, err := loadBackupPlaylists(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var saved []Item
+	err = readJSON(filepath.Join(dir, "saved_tracks.json"), &saved)
+	switch {
+	case err == nil:
+		playlists = append([]backupPlaylist{{Playlist: Playlist{Id: savedTracksId, Name: "Saved tracks"}, Items: saved}}, playlists...)
+	case !os.IsNotExist(errors.Cause(err)):
+		return nil, errors.Wrap(err, "failed to read saved tracks")
+	}
+
+	return &browser{manifest: manifest, playlists: playlists}, nil
+}
+
+// serveBackup serves the browser for the backup in dir on localhost:port
+// until ctx is cancelled.
+func serveBackup(ctx context.Context, dir string, port int) error {
+	b, err := loadBrowser(dir)
+	if err != nil {
+		return errors.Wrapf(err, "failed to load backup %s", dir)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(servePage)
+	})
+	mux.HandleFunc("GET /api/backup", func(w http.ResponseWriter, r *http.Request) {
+		writeAPIResponse(w, b.manifest)
+	})
+	mux.HandleFunc("GET /api/playlists", func(w http.ResponseWriter, r *http.Request) {
+		writeAPIResponse(w, b.listPlaylists())
+	})
+	mux.HandleFunc("GET /api/tracks", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		writeAPIResponse(w, b.findTracks(query.Get("playlist"), query.Get("q"), query.Get("sort")))
+	})
+
+	srv := &http.Server{Addr: fmt.Sprintf("localhost:%d", port), Handler: mux}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.ListenAndServe()
+	}()
+	slog.Info("Serving backup, press Ctrl-C to stop", "dir", dir, "url", fmt.Sprintf("http://localhost:%d/", port))
+
+	select {
+	case err := <-errs:
+		return errors.Wrap(err, "backup browser failed")
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return srv.Shutdown(shutdownCtx)
+}
+
+func writeAPIResponse(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		slog.Warn("Error writing response", "error", err)
+	}
+}
+
+func (b *browser) listPlaylists() []browserPlaylist {
+	playlists := make([]browserPlaylist, len(b.playlists))
+	for i, p := range b.playlists {
+		playlists[i] = browserPlaylist{
+			Id:         p.Playlist.Id,
+			Name:       p.Playlist.Name,
+			Owner:      p.Playlist.Owner.DisplayName,
+			TrackCount: len(p.Items),
+		}
+	}
+
+	return playlists
+}
+
+// findTracks returns the tracks of the playlist with id playlistId, or of all
+// playlists if it's empty, whose name, artists or album contain search. They
+// are sorted by sortBy: "added" or "-added" for the date added, oldest or
+// newest first, "name", or playlist order otherwise.
+func (b *browser) findTracks(playlistId string, search string, sortBy string) []browserTrack {
+	search = strings.ToLower(search)
+	tracks := make([]browserTrack, 0)
+	for _, p := range b.playlists {
+		if playlistId != "" && p.Playlist.Id != playlistId {
+			continue
+		}
+
+		for _, item := range p.Items {
+			track := browserTrack{
+				Playlist:   p.Playlist.Name,
+				PlaylistId: p.Playlist.Id,
+				Name:       item.Track.Name,
+				Artists:    artistNames(item.Track.Artists, ", "),
+				Album:      item.Track.Album.Name,
+				AddedAt:    item.AddedAt,
+				DurationMs: item.Track.DurationMs,
+				Url:        item.Track.ExternalUrls.Spotify,
+			}
+			if search != "" && !strings.Contains(strings.ToLower(track.Name+"\n"+track.Artists+"\n"+track.Album), search) {
+				continue
+			}
+			tracks = append(tracks, track)
+		}
+	}
+
+	switch sortBy {
+	case "added":
+		sort.SliceStable(tracks, func(i, j int) bool { return tracks[i].AddedAt < tracks[j].AddedAt })
+	case "-added":
+		sort.SliceStable(tracks, func(i, j int) bool { return tracks[i].AddedAt > tracks[j].AddedAt })
+	case "name":
+		sort.SliceStable(tracks, func(i, j int) bool { return strings.ToLower(tracks[i].Name) < strings.ToLower(tracks[j].Name) })
+	}
+
+	return tracks
+}
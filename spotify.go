@@ -0,0 +1,690 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+	"golang.org/x/time/rate"
+)
+
+// SpotifyClient talks to the Spotify Web API. All requests share one rate
+// limiter, and baseURL can be pointed at a mock server.
+type SpotifyClient struct {
+	http    *http.Client
+	baseURL string
+	limiter *rate.Limiter
+
+	// market is the country whose catalog tracks are relinked to. Empty
+	// leaves it to Spotify, which uses the country of the user.
+	market string
+
+	// includeEpisodes asks for podcast episodes in playlists along with the
+	// tracks.
+	includeEpisodes bool
+
+	// maxTracks is the most items fetched per playlist, or 0 for all.
+	maxTracks int
+
+	// includeMarkets keeps the countries each track is available in, which
+	// make up most of the size of a track otherwise.
+	includeMarkets bool
+
+	// parallelPages is how many pages of a playlist are fetched at once once
+	// its length is known. 1 or less fetches them one after another.
+	parallelPages int
+
+	// backoffScale multiplies the waits between retries. 0 is the same as 1.
+	backoffScale int
+
+	// adaptive limits the requests in flight with -max-concurrency, and is
+	// nil otherwise.
+	adaptive *adaptiveConcurrency
+}
+
+func NewSpotifyClient(httpClient *http.Client, limiter *rate.Limiter) *SpotifyClient {
+	return &SpotifyClient{
+		http:    httpClient,
+		baseURL: baseAPIAddress,
+		limiter: limiter,
+	}
+}
+
+// SpotifyError is the error object returned by the Web API for non-2xx responses.
+type SpotifyError struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+func (e *SpotifyError) Error() string {
+	return fmt.Sprintf("spotify API error %d: %s", e.Status, e.Message)
+}
+
+// defaultRetryAfter is used when a 429 response lacks a usable Retry-After header.
+const defaultRetryAfter = 5 * time.Second
+
+// doRequestWithRetry sends a request and decodes the JSON response into out,
+// if given, as it is read. Rate-limited requests are retried after the delay
+// Spotify asks for. Server errors and network failures are retried with
+// exponential backoff, but only for GETs: a POST whose response was lost may
+// still have been applied, and sending it again would add the same tracks or
+// create the same playlist twice. Any other non-2xx status is returned as an
+// error. With adaptive concurrency, the request holds its slot through its retries,
+// so rate limiting holds back new requests too.
+func (c *SpotifyClient) doRequestWithRetry(ctx context.Context, method string, url string, body []byte, out interface{}) error {
+	if err := c.adaptive.acquire(ctx); err != nil {
+		return err
+	}
+	defer c.adaptive.release()
+
+	// Rate-limited requests weren't processed, so those are retried whatever
+	// the method.
+	idempotent := method == http.MethodGet
+	for attempt := 0; ; attempt++ {
+		if err := c.limiter.Wait(ctx); err != nil {
+			return errors.Wrap(err, "rate limiter")
+		}
+		stats.apiCalls.Add(1)
+
+		req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+		if err != nil {
+			return errors.Wrap(err, "failed to create request")
+		}
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		resp, err := c.http.Do(req)
+		if err != nil {
+			if idempotent && attempt < *maxRetries && ctx.Err() == nil && isRetryableError(err) {
+				if err := c.backoff(ctx, attempt, url, err); err != nil {
+					return err
+				}
+				continue
+			}
+			return errors.Wrap(err, "request failed")
+		}
+
+		slog.Debug("Request", "method", method, "url", url, "status", resp.StatusCode)
+
+		if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+			c.adaptive.succeeded()
+			err := decodeBody(resp.Body, out)
+			resp.Body.Close()
+			if err != nil && idempotent && attempt < *maxRetries && ctx.Err() == nil && !isDecodeError(err) {
+				if err := c.backoff(ctx, attempt, url, err); err != nil {
+					return err
+				}
+				continue
+			}
+			return errors.Wrap(err, "failed to read response")
+		}
+
+		// Error responses are small, so they are read whole.
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			if idempotent && attempt < *maxRetries && ctx.Err() == nil {
+				if err := c.backoff(ctx, attempt, url, err); err != nil {
+					return err
+				}
+				continue
+			}
+			return errors.Wrap(err, "failed to read response")
+		}
+
+		if resp.StatusCode == http.StatusTooManyRequests {
+			stats.rateLimited.Add(1)
+			c.adaptive.rateLimited()
+		}
+		if resp.StatusCode == http.StatusTooManyRequests && attempt < *maxRetries {
+			stats.retries.Add(1)
+			wait := retryAfter(resp)
+			slog.Warn("Rate limited, retrying", "wait", wait)
+			if err := sleepContext(ctx, wait); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if idempotent && isRetryableStatus(resp.StatusCode) && attempt < *maxRetries {
+			if err := c.backoff(ctx, attempt, url, errors.New(resp.Status)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		return errors.Wrapf(parseSpotifyError(resp, data), "request to %s failed", url)
+	}
+}
+
+// decodeBody decodes a JSON response body into out. Without out the body is
+// drained, so the connection can be reused.
+func decodeBody(body io.Reader, out interface{}) error {
+	if out == nil {
+		_, err := io.Copy(io.Discard, body)
+		return err
+	}
+
+	return json.NewDecoder(body).Decode(out)
+}
+
+// isDecodeError reports whether err is from invalid JSON rather than from
+// failing to read the body, in which case retrying won't help.
+func isDecodeError(err error) bool {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	return errors.As(err, &syntaxErr) || errors.As(err, &typeErr)
+}
+
+// get sends a GET request and decodes the response into out.
+func (c *SpotifyClient) get(ctx context.Context, url string, out interface{}) error {
+	return c.doRequestWithRetry(ctx, http.MethodGet, url, nil, out)
+}
+
+// postJSON sends payload as JSON and decodes the response into out, if given.
+func (c *SpotifyClient) postJSON(ctx context.Context, url string, payload interface{}, out interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal request body")
+	}
+
+	return c.doRequestWithRetry(ctx, http.MethodPost, url, body, out)
+}
+
+// putJSON sends payload as JSON with PUT and decodes the response into out,
+// if given.
+func (c *SpotifyClient) putJSON(ctx context.Context, url string, payload interface{}, out interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal request body")
+	}
+
+	return c.doRequestWithRetry(ctx, http.MethodPut, url, body, out)
+}
+
+// parseSpotifyError decodes the error body of a failed response, falling back
+// to the HTTP status when the body isn't a Spotify error object.
+func parseSpotifyError(resp *http.Response, data []byte) *SpotifyError {
+	var body struct {
+		Error SpotifyError `json:"error"`
+	}
+	if err := json.Unmarshal(data, &body); err != nil || body.Error.Status == 0 {
+		return &SpotifyError{Status: resp.StatusCode, Message: http.StatusText(resp.StatusCode)}
+	}
+
+	return &body.Error
+}
+
+const (
+	baseBackoff = time.Second
+	maxBackoff  = 30 * time.Second
+
+	// retryBackoffScale is the backoffScale of the retry pass over failed
+	// playlists, so requests that kept failing get more time to recover.
+	retryBackoffScale = 4
+)
+
+// backoff waits before retry number attempt+1: exponentially longer for each
+// attempt, with jitter so parallel workers don't retry in lockstep.
+func (c *SpotifyClient) backoff(ctx context.Context, attempt int, url string, cause error) error {
+	wait := baseBackoff << attempt
+	if wait > maxBackoff || wait <= 0 {
+		wait = maxBackoff
+	}
+	if c.backoffScale > 1 {
+		wait *= time.Duration(c.backoffScale)
+	}
+	wait += time.Duration(rand.Int63n(int64(wait/2) + 1))
+
+	stats.retries.Add(1)
+	slog.Debug("Retrying request", "url", url, "attempt", attempt+1, "wait", wait, "error", cause)
+	return sleepContext(ctx, wait)
+}
+
+func isRetryableStatus(status int) bool {
+	switch status {
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+
+	return false
+}
+
+// isRetryableError reports whether a failed request is worth retrying. Network
+// errors are; failing to refresh the token, which comes back the same way, is
+// not.
+func isRetryableError(err error) bool {
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &retrieveErr) {
+		return false
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// isNotFound reports whether a request failed because the object is gone,
+// such as a playlist deleted after it was listed.
+func isNotFound(err error) bool {
+	var spotifyErr *SpotifyError
+	return errors.As(err, &spotifyErr) && spotifyErr.Status == http.StatusNotFound
+}
+
+// sleepContext sleeps for d, returning early with the context's error if ctx
+// is cancelled first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func retryAfter(resp *http.Response) time.Duration {
+	seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || seconds < 0 {
+		return defaultRetryAfter
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
+func (c *SpotifyClient) fetchCurrentUser(ctx context.Context) (*User, error) {
+	var user User
+	if err := c.get(ctx, fmt.Sprintf("%s/v1/me", c.baseURL), &user); err != nil {
+		return nil, errors.Wrap(err, "failed to fetch current user")
+	}
+
+	return &user, nil
+}
+
+// fetchPlaylists fetches the playlists of the logged in user, or the public
+// playlists of userId if it's set.
+func (c *SpotifyClient) fetchPlaylists(ctx context.Context, userId string) ([]Playlist, error) {
+	limit := 50
+	playlists := make([]Playlist, 0)
+	nextPageUrl := fmt.Sprintf("%s/v1/me/playlists?offset=0&limit=%d", c.baseURL, limit)
+	if userId != "" {
+		nextPageUrl = fmt.Sprintf("%s/v1/users/%s/playlists?offset=0&limit=%d", c.baseURL, url.PathEscape(userId), limit)
+	}
+
+	for nextPageUrl != "" {
+		var page PlaylistPage
+		if err := c.get(ctx, nextPageUrl, &page); err != nil {
+			return nil, errors.Wrap(err, "failed to fetch playlists")
+		}
+		playlists = append(playlists, page.Items...)
+		logPage("Fetched playlists", "count", len(playlists))
+		nextPageUrl = page.Next
+	}
+
+	return playlists, nil
+}
+
+// fetchPlaylistTracks fetches the items of a playlist, returning its tracks
+// and, separately, its podcast episodes. Episodes are only returned with
+// includeEpisodes set. With maxTracks set, it stops after that many items and
+// marks the result as truncated.
+func (c *SpotifyClient) fetchPlaylistTracks(ctx context.Context, playlist Playlist) playlistResult {
+	limit := 100
+	tracks := make([]Item, 0)
+	truncated := false
+	nextPageUrl := c.playlistTracksURL(playlist, 0, limit)
+
+	for nextPageUrl != "" {
+		var page TracksPage
+		if err := c.get(ctx, nextPageUrl, &page); err != nil {
+			return playlistResult{Playlist: playlist, Err: errors.Wrapf(err, "failed to fetch tracks for playlist %s", playlist.Name)}
+		}
+		c.preparePage(page.Items, len(tracks))
+		tracks = append(tracks, page.Items...)
+
+		logPage("Fetched tracks", "playlist", playlist.Name, "page", len(page.Items), "total", len(tracks))
+		nextPageUrl = page.Next
+
+		// The first page tells how many tracks there are, so with
+		// parallelPages the rest are fetched at once by offset.
+		if c.parallelPages > 1 && nextPageUrl != "" {
+			end := page.Total
+			if c.maxTracks > 0 && end > c.maxTracks {
+				end = c.maxTracks
+				truncated = true
+			}
+			rest, err := c.fetchPagesByOffset(ctx, playlist, len(tracks), end, limit)
+			if err != nil {
+				return playlistResult{Playlist: playlist, Err: errors.Wrapf(err, "failed to fetch tracks for playlist %s", playlist.Name)}
+			}
+			tracks = append(tracks, rest...)
+			logPage("Fetched tracks", "playlist", playlist.Name, "page", len(rest), "total", len(tracks))
+			nextPageUrl = ""
+		}
+
+		if c.maxTracks > 0 && len(tracks) >= c.maxTracks {
+			truncated = truncated || nextPageUrl != "" || len(tracks) > c.maxTracks
+			tracks = tracks[:c.maxTracks]
+			break
+		}
+	}
+	if truncated {
+		slog.Info("Playlist has more tracks than -max-tracks-per-playlist, truncating", "playlist", playlist.Name, "tracks", len(tracks), "total", playlist.Tracks.Total)
+	}
+
+	tracks, episodes := splitEpisodes(tracks)
+	if !c.includeEpisodes {
+		episodes = nil
+	}
+
+	tracks, removed := dropUnavailable(tracks)
+	if removed > 0 {
+		slog.Info("Skipping unavailable tracks", "playlist", playlist.Name, "tracks", removed)
+	}
+
+	// Who added a track only matters in collaborative playlists; in the
+	// others it's always the owner.
+	if !playlist.Collaborative {
+		for i := range tracks {
+			tracks[i].AddedBy = nil
+		}
+	}
+
+	return playlistResult{Playlist: playlist, Items: tracks, Episodes: episodes, Truncated: truncated}
+}
+
+func (c *SpotifyClient) playlistTracksURL(playlist Playlist, offset int, limit int) string {
+	url := fmt.Sprintf("%s/v1/playlists/%s/tracks?offset=%d&limit=%d%s", c.baseURL, playlist.Id, offset, limit, c.marketQuery())
+	if c.includeEpisodes {
+		url += "&additional_types=track,episode"
+	}
+
+	return url
+}
+
+// fetchPagesByOffset fetches the playlist items from start up to end, with up
+// to parallelPages pages at a time, and returns them in playlist order.
+func (c *SpotifyClient) fetchPagesByOffset(ctx context.Context, playlist Playlist, start int, end int, limit int) ([]Item, error) {
+	var offsets []int
+	for offset := start; offset < end; offset += limit {
+		offsets = append(offsets, offset)
+	}
+
+	pages := make([][]Item, len(offsets))
+	errs := make([]error, len(offsets))
+	sem := make(chan struct{}, c.parallelPages)
+	var wg sync.WaitGroup
+	for i, offset := range offsets {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, offset int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			var page TracksPage
+			if errs[i] = c.get(ctx, c.playlistTracksURL(playlist, offset, limit), &page); errs[i] == nil {
+				c.preparePage(page.Items, offset)
+				pages[i] = page.Items
+			}
+		}(i, offset)
+	}
+	wg.Wait()
+
+	items := make([]Item, 0)
+	for i := range pages {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		items = append(items, pages[i]...)
+	}
+
+	return items, nil
+}
+
+// preparePage numbers the items of a page that starts at offset, and drops
+// the available markets unless includeMarkets is set.
+func (c *SpotifyClient) preparePage(items []Item, offset int) {
+	for i := range items {
+		items[i].Position = offset + i
+		if !c.includeMarkets {
+			items[i].Track.AvailableMarkets = nil
+		}
+	}
+}
+
+type playlistResult struct {
+	Playlist  Playlist
+	Items     []Item
+	Episodes  []PlaylistEpisode
+	Truncated bool
+	Err       error
+}
+
+// marketQuery returns the market parameter for track requests. The next page
+// links Spotify returns keep it.
+func (c *SpotifyClient) marketQuery() string {
+	if c.market == "" {
+		return ""
+	}
+
+	return "&market=" + url.QueryEscape(c.market)
+}
+
+// fetchAllPlaylistTracks fetches the tracks of every playlist using at most
+// concurrency workers, all sharing the same rate limiter. Results are returned
+// in the same order as playlists, with any per-playlist error recorded in the
+// result. Once ctx is cancelled no new playlists are started.
+func (c *SpotifyClient) fetchAllPlaylistTracks(ctx context.Context, playlists []Playlist, concurrency int) []playlistResult {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	results := make([]playlistResult, len(playlists))
+
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, p := range playlists {
+		sem <- struct{}{}
+		if ctx.Err() != nil {
+			// Cancelled: record the playlists that were never started.
+			<-sem
+			results[i] = playlistResult{Playlist: p, Err: ctx.Err()}
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, p Playlist) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			results[i] = c.fetchPlaylistTracks(ctx, p)
+			progress.increment()
+		}(i, p)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// retryFailedPlaylists fetches the playlists in results that failed once more,
+// one at a time and with longer waits between retries, and replaces their
+// results. Playlists that were deleted aren't retried.
+func (c *SpotifyClient) retryFailedPlaylists(ctx context.Context, results []playlistResult) {
+	var retry []Playlist
+	var retryIndex []int
+	for i, result := range results {
+		if result.Err != nil && !isNotFound(result.Err) {
+			retry = append(retry, result.Playlist)
+			retryIndex = append(retryIndex, i)
+		}
+	}
+	if len(retry) == 0 || ctx.Err() != nil {
+		return
+	}
+
+	slog.Warn("Retrying failed playlists", "playlists", len(retry))
+	c.backoffScale = retryBackoffScale
+	defer func() { c.backoffScale = 0 }()
+
+	for i, result := range c.fetchAllPlaylistTracks(ctx, retry, 1) {
+		if result.Err == nil {
+			slog.Info("Fetched playlist on retry", "playlist", result.Playlist.Name)
+		}
+		results[retryIndex[i]] = result
+	}
+}
+
+func (c *SpotifyClient) fetchSavedTracks(ctx context.Context) ([]Item, error) {
+	limit := 50
+	tracks := make([]Item, 0)
+	nextPageUrl := fmt.Sprintf("%s/v1/me/tracks?offset=0&limit=%d%s", c.baseURL, limit, c.marketQuery())
+
+	for nextPageUrl != "" {
+		var page TracksPage
+		if err := c.get(ctx, nextPageUrl, &page); err != nil {
+			return nil, errors.Wrap(err, "failed to fetch saved tracks")
+		}
+		c.preparePage(page.Items, len(tracks))
+		tracks = append(tracks, page.Items...)
+
+		logPage("Fetched saved tracks", "count", len(tracks))
+		nextPageUrl = page.Next
+	}
+
+	tracks, removed := dropUnavailable(tracks)
+	if removed > 0 {
+		slog.Info("Skipping unavailable saved tracks", "tracks", removed)
+	}
+
+	return tracks, nil
+}
+
+// fetchSavedTracksTotal returns the number of saved tracks using a single
+// one-item request.
+func (c *SpotifyClient) fetchSavedTracksTotal(ctx context.Context) (int, error) {
+	var page TracksPage
+	if err := c.get(ctx, fmt.Sprintf("%s/v1/me/tracks?offset=0&limit=1", c.baseURL), &page); err != nil {
+		return 0, errors.Wrap(err, "failed to fetch saved tracks")
+	}
+
+	return page.Total, nil
+}
+
+func (c *SpotifyClient) fetchSavedShows(ctx context.Context) ([]SavedShow, error) {
+	limit := 50
+	shows := make([]SavedShow, 0)
+	nextPageUrl := fmt.Sprintf("%s/v1/me/shows?offset=0&limit=%d", c.baseURL, limit)
+
+	for nextPageUrl != "" {
+		var page ShowsPage
+		if err := c.get(ctx, nextPageUrl, &page); err != nil {
+			return nil, errors.Wrap(err, "failed to fetch saved shows")
+		}
+		shows = append(shows, page.Items...)
+		logPage("Fetched saved shows", "count", len(shows))
+		nextPageUrl = page.Next
+	}
+
+	return shows, nil
+}
+
+func (c *SpotifyClient) fetchSavedEpisodes(ctx context.Context) ([]SavedEpisode, error) {
+	limit := 50
+	episodes := make([]SavedEpisode, 0)
+	nextPageUrl := fmt.Sprintf("%s/v1/me/episodes?offset=0&limit=%d", c.baseURL, limit)
+
+	for nextPageUrl != "" {
+		var page EpisodesPage
+		if err := c.get(ctx, nextPageUrl, &page); err != nil {
+			return nil, errors.Wrap(err, "failed to fetch saved episodes")
+		}
+		episodes = append(episodes, page.Items...)
+		logPage("Fetched saved episodes", "count", len(episodes))
+		nextPageUrl = page.Next
+	}
+
+	return episodes, nil
+}
+
+// addPlaylistDetails fills in the follower count and description of each
+// playlist from its details endpoint, which the playlist listing leaves out.
+// Playlists whose details can't be fetched are left as they are.
+func (c *SpotifyClient) addPlaylistDetails(ctx context.Context, playlists []Playlist) {
+	for i, p := range playlists {
+		var details struct {
+			Description string    `json:"description"`
+			Followers   Followers `json:"followers"`
+		}
+		url := fmt.Sprintf("%s/v1/playlists/%s?fields=description,followers.total", c.baseURL, p.Id)
+		if err := c.get(ctx, url, &details); err != nil {
+			slog.Warn("Error fetching playlist details", "playlist", p.Name, "error", err)
+			continue
+		}
+
+		playlists[i].Description = details.Description
+		playlists[i].Followers = &details.Followers
+	}
+}
+
+// audioFeaturesPerRequest is the most ids the audio features endpoint accepts.
+const audioFeaturesPerRequest = 100
+
+// addAudioFeatures fetches the audio features of every track in items that
+// doesn't have them yet. Tracks without features, such as local tracks, are
+// left without.
+func (c *SpotifyClient) addAudioFeatures(ctx context.Context, items []Item) error {
+	var ids []string
+	seen := make(map[string]bool)
+	for _, item := range items {
+		id := item.Track.Id
+		if id == "" || item.Track.IsLocal || item.Track.AudioFeatures != nil || seen[id] {
+			continue
+		}
+		seen[id] = true
+		ids = append(ids, id)
+	}
+
+	features := make(map[string]*AudioFeatures, len(ids))
+	for start := 0; start < len(ids); start += audioFeaturesPerRequest {
+		end := start + audioFeaturesPerRequest
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		var page struct {
+			AudioFeatures []*AudioFeatures `json:"audio_features"`
+		}
+		if err := c.get(ctx, fmt.Sprintf("%s/v1/audio-features?ids=%s", c.baseURL, strings.Join(ids[start:end], ",")), &page); err != nil {
+			return errors.Wrap(err, "failed to fetch audio features")
+		}
+		for _, f := range page.AudioFeatures {
+			if f != nil {
+				features[f.Id] = f
+			}
+		}
+	}
+
+	for i := range items {
+		if f, ok := features[items[i].Track.Id]; ok {
+			items[i].Track.AudioFeatures = f
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// stats counts the work done during a run. The counters are updated from the
+// concurrent playlist fetches, so they are atomic.
+var stats RunStats
+
+type RunStats struct {
+	apiCalls    atomic.Int64
+	retries     atomic.Int64
+	rateLimited atomic.Int64
+}
+
+// RunStatsReport is the stats.json written at the end of a run.
+type RunStatsReport struct {
+	Playlists       int     `json:"playlists"`
+	FailedPlaylists int     `json:"failed_playlists"`
+	Tracks          int     `json:"tracks"`
+	SavedTracks     int     `json:"saved_tracks"`
+	APICalls        int64   `json:"api_calls"`
+	Retries         int64   `json:"retries"`
+	RateLimited     int64   `json:"rate_limited"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	BytesWritten    int64   `json:"bytes_written"`
+}
+
+// reset zeroes the counters before another run in the same process.
+func (s *RunStats) reset() {
+	s.apiCalls.Store(0)
+	s.retries.Store(0)
+	s.rateLimited.Store(0)
+}
+
+// report summarises the run so far. Bytes written is the size of the files in
+// runDir, so it doesn't include stats.json itself or an archive.
+func (s *RunStats) report(manifest *Manifest, failed int, started time.Time, runDir string) RunStatsReport {
+	var size int64
+	storage.Walk(runDir, func(path string, rel string, n int64) error {
+		size += n
+		return nil
+	})
+
+	return RunStatsReport{
+		Playlists:       manifest.TotalPlaylists,
+		FailedPlaylists: failed,
+		Tracks:          manifest.TotalTracks,
+		SavedTracks:     manifest.SavedTracks,
+		APICalls:        s.apiCalls.Load(),
+		Retries:         s.retries.Load(),
+		RateLimited:     s.rateLimited.Load(),
+		DurationSeconds: time.Since(started).Round(time.Millisecond).Seconds(),
+		BytesWritten:    size,
+	}
+}
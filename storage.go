@@ -0,0 +1,129 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Storage is where the files of a backup run are written, and where earlier
+// runs are read back from. Paths are the file paths built by backupFilePath
+// and friends.
+type Storage interface {
+	// Write saves data as path, replacing any file there.
+	Write(path string, data []byte) error
+	// Create saves the output of write as path. The file is streamed rather
+	// than held in memory, and only replaces a file already there if write
+	// succeeds.
+	Create(path string, write func(w io.Writer) error) error
+	// Open opens path for reading. The error for a missing file satisfies
+	// os.IsNotExist.
+	Open(path string) (io.ReadCloser, error)
+	Exists(path string) (bool, error)
+	Mkdir(path string) error
+	// Walk calls fn for every file below dir in lexical order, with its path,
+	// its path relative to dir and its size.
+	Walk(dir string, fn func(path string, rel string, size int64) error) error
+	// Remove deletes path and everything below it. A missing path isn't an
+	// error.
+	Remove(path string) error
+	// Link makes link show the files of the run folder target, next to it.
+	Link(target string, link string) error
+}
+
+// storage is the Storage every backup file is saved through.
+var storage Storage = FSStorage{}
+
+// FSStorage writes to the local file system. Files are written atomically, so
+// an interrupted run never leaves a truncated file behind.
+type FSStorage struct{}
+
+func (s FSStorage) Write(path string, data []byte) error {
+	return s.Create(path, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+func (FSStorage) Create(path string, write func(w io.Writer) error) error {
+	return writeFileAtomic(path, 0644, write)
+}
+
+func (FSStorage) Open(path string) (io.ReadCloser, error) {
+	return os.Open(path)
+}
+
+func (FSStorage) Exists(path string) (bool, error) {
+	_, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+func (FSStorage) Mkdir(path string) error {
+	return os.MkdirAll(path, 0755)
+}
+
+// Walk follows dir if it's a symlink, such as the latest link, since
+// filepath.Walk doesn't. Paths are still given below dir.
+func (FSStorage) Walk(dir string, fn func(path string, rel string, size int64) error) error {
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		return fn(filepath.Join(dir, rel), rel, info.Size())
+	})
+}
+
+func (FSStorage) Remove(path string) error {
+	return os.RemoveAll(path)
+}
+
+// Link uses a relative symlink where possible, falling back to a copy on
+// systems without symlinks.
+func (s FSStorage) Link(target string, link string) error {
+	if err := os.Symlink(filepath.Base(target), link); err == nil {
+		return nil
+	}
+
+	return copyFiles(s, target, link)
+}
+
+// copyFiles copies every file below src in s to the same path below dst.
+func copyFiles(s Storage, src string, dst string) error {
+	return s.Walk(src, func(path string, rel string, size int64) error {
+		target := filepath.Join(dst, rel)
+		if err := s.Mkdir(filepath.Dir(target)); err != nil {
+			return err
+		}
+
+		return copyFile(s, path, target)
+	})
+}
+
+// copyFile copies the file src in s to dst.
+func copyFile(s Storage, src string, dst string) error {
+	in, err := s.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	return s.Create(dst, func(w io.Writer) error {
+		_, err := io.Copy(w, in)
+		return err
+	})
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestVerifyThroughLatestSymlink(t *testing.T) {
+	previous := storage
+	t.Cleanup(func() { storage = previous })
+	storage = FSStorage{}
+
+	root := t.TempDir()
+	runDir, err := createRunDir(root, time.Date(2024, 1, 15, 14, 30, 5, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := saveJSONToFile(runDir, "a", []Item{{AddedAt: "2024-01-15T10:00:00Z"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeChecksums(runDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := updateLatest(root, runDir); err != nil {
+		t.Fatal(err)
+	}
+
+	latest := filepath.Join(root, latestName)
+	if info, err := os.Lstat(latest); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Skipf("%s isn't a symlink on this system", latest)
+	}
+
+	var paths []string
+	err = storage.Walk(latest, func(path string, rel string, size int64) error {
+		paths = append(paths, path)
+		if path != filepath.Join(latest, rel) {
+			t.Errorf("Walk gave %s for %s, want it below %s", path, rel, latest)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 2 {
+		t.Errorf("Walk found %v below %s, want a.json and %s", paths, latest, checksumFile)
+	}
+
+	if problems, err := verifyChecksums(latest); err != nil || problems != 0 {
+		t.Errorf("verifying %s found %d problems, %v", latest, problems, err)
+	}
+}